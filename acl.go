@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"time"
+)
+
+type (
+	// AddressAuth extends kite.AddressAuth with access control list and activation code creation time,
+	// address without rule can send any action to any receiver
+	AddressAuth struct {
+		kite.AddressAuth `bson:",inline"`
+		Acl              []AclRule `bson:"acl,omitempty" json:"acl,omitempty"`
+		ActivationTime   time.Time `bson:"activation_time,omitempty" json:"activation_time,omitempty"`
+	}
+
+	// AclRule allow actions (all if empty or "*") to receivers covered by Receiver pattern
+	AclRule struct {
+		Receiver string        `bson:"receiver" json:"receiver"`
+		Actions  []kite.Action `bson:"actions,omitempty" json:"actions,omitempty"`
+	}
+)
+
+// allowed function check if one of ACL rules allow action to receiver
+func allowed(acl []AclRule, action kite.Action, receiver kite.Address) bool {
+	if len(acl) == 0 {
+		return true
+	}
+
+	for _, rule := range acl {
+		pattern := kite.Address{}
+		pattern.StringToAddress(rule.Receiver)
+		// Receiver pattern must be covered by rule, a wildcard receiver need a wildcard rule
+		if !receiver.Match(pattern) {
+			continue
+		}
+		if len(rule.Actions) == 0 {
+			return true
+		}
+		for _, a := range rule.Actions {
+			if a == action || a == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkAcl function reject and log message not allowed by sender ACL, receiver is the address (or pattern)
+// message action applies to
+func (ks *KiteServer) checkAcl(message Envelope, this *AddressObs, receiver kite.Address) bool {
+	if allowed(this.acl, message.Action, receiver) {
+		return true
+	}
+
+	violation := fmt.Sprintf("%s action to %s not allowed for %s", message.Action, receiver, this.address)
+	log.Printf("ACL violation --> %s", violation)
+	ks.writeLog("ACL violation --> "+violation, this.address)
+
+	ks.replyError(this, message, ErrorReply{Code: E_FORBIDDEN, Message: violation})
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type (
+	ConfActivation struct {
+		Lifetime    int `json:"lifetime"`
+		MaxAttempts int `json:"max_attempts"`
+		Lockout     int `json:"lockout"`
+	}
+
+	// Attempts count failed activations per source (authorization of websocket address or Telegram chat)
+	Attempts struct {
+		sync     sync.Mutex
+		failures map[string]*attempt
+	}
+
+	attempt struct {
+		count  int
+		last   time.Time
+		locked time.Time
+	}
+)
+
+const (
+	defaultActivationLifetime    = 3600
+	defaultActivationMaxAttempts = 5
+	defaultActivationLockout     = 900
+)
+
+var ErrActivationLocked = errors.New("too many failed activation attempts")
+
+func (c ConfActivation) lifetime() time.Duration {
+	if c.Lifetime <= 0 {
+		return defaultActivationLifetime * time.Second
+	}
+	return time.Duration(c.Lifetime) * time.Second
+}
+
+func (c ConfActivation) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return defaultActivationMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+func (c ConfActivation) lockout() time.Duration {
+	if c.Lockout <= 0 {
+		return defaultActivationLockout * time.Second
+	}
+	return time.Duration(c.Lockout) * time.Second
+}
+
+// activateAddress function enable pending address authorization owning a not expired activation code,
+// source is locked out after too many failures
+func (ks *KiteServer) activateAddress(activationCode string, source string) error {
+	if ks.activationLocked(source) {
+		return ErrActivationLocked
+	}
+
+	addressAuths, err := ks.store().ListAddressAuth()
+	if err != nil {
+		return err
+	}
+	for _, addressAuth := range addressAuths {
+		if addressAuth.ActivationCode == "" || ks.activationExpired(addressAuth) {
+			continue
+		}
+		if checkSecret(addressAuth.ActivationCode, activationCode) {
+			ks.attempts.sync.Lock()
+			delete(ks.attempts.failures, source)
+			ks.attempts.sync.Unlock()
+			return ks.store().ActivateAddress(addressAuth.Name)
+		}
+	}
+
+	ks.activationFailed(source)
+	return ErrNotFound
+}
+
+// registrationSource function return source of registrations of unknown addresses, the remote host of connection
+func registrationSource(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "register:" + host
+}
+
+func (ks *KiteServer) activationExpired(addressAuth AddressAuth) bool {
+	return time.Since(addressAuth.ActivationTime) > ks.config().Activation.lifetime()
+}
+
+func (ks *KiteServer) activationLocked(source string) bool {
+	ks.attempts.sync.Lock()
+	defer ks.attempts.sync.Unlock()
+
+	a, ok := ks.attempts.failures[source]
+	return ok && time.Now().Before(a.locked)
+}
+
+// activationFailed function count failed attempt, source is locked when max attempts is reached
+func (ks *KiteServer) activationFailed(source string) {
+	ks.attempts.sync.Lock()
+	defer ks.attempts.sync.Unlock()
+
+	a, ok := ks.attempts.failures[source]
+	if !ok {
+		a = &attempt{}
+		ks.attempts.failures[source] = a
+	}
+	a.count++
+	a.last = time.Now()
+	if a.count >= ks.config().Activation.maxAttempts() {
+		a.count = 0
+		a.locked = time.Now().Add(ks.config().Activation.lockout())
+		log.Printf("Activation locked for %s until %s", source, a.locked.Format(time.RFC3339))
+		ks.sendToTelegram("Too many failed activation attempts from " + source)
+	}
+}
+
+// cleanupActivations function remove expired pending registrations and forget old failed attempts
+func (ks *KiteServer) cleanupActivations() {
+	if addressAuths, err := ks.store().ListAddressAuth(); err == nil {
+		for _, addressAuth := range addressAuths {
+			if !addressAuth.Enabled && addressAuth.ActivationCode != "" && ks.activationExpired(addressAuth) {
+				if err := ks.store().DeleteAddressAuth(addressAuth.Name); err != nil {
+					log.Printf("Error deleting expired registration %s --> %v", addressAuth.Name, err)
+				} else {
+					log.Printf("Expired registration %s deleted", addressAuth.Name)
+				}
+			}
+		}
+	} else {
+		log.Printf("Error reading address authorizations --> %v", err)
+	}
+
+	ks.attempts.sync.Lock()
+	defer ks.attempts.sync.Unlock()
+	for source, a := range ks.attempts.failures {
+		if time.Now().After(a.locked) && time.Since(a.last) > ks.config().Activation.lockout() {
+			delete(ks.attempts.failures, source)
+		}
+	}
+}
+
+// watchActivations function periodically cleanup activations
+func (ks *KiteServer) watchActivations() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if ks.store() != nil {
+			ks.cleanupActivations()
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestActivationAttempts(t *testing.T) {
+	ks, _ := newTestServer(t, func(conf *ServerConf) {
+		conf.Activation = ConfActivation{Lifetime: 60, MaxAttempts: 2, Lockout: 60}
+	})
+	pending := func(name string, code string, created time.Time) {
+		hash, _ := hashSecret(code)
+		_ = ks.db.UpsertAddressAuth(AddressAuth{AddressAuth: kite.AddressAuth{Name: name, ActivationCode: hash}, ActivationTime: created})
+	}
+	pending("test.cli.first.*.*", "FIRST1", time.Now())
+	pending("test.cli.expired.*.*", "EXPIRED", time.Now().Add(-2*time.Minute))
+
+	// Expired code is refused and cleaned up
+	if err := ks.activateAddress("EXPIRED", "ws:other"); err != ErrNotFound {
+		t.Errorf("expired code activation = %v, want ErrNotFound", err)
+	}
+	ks.cleanupActivations()
+	if _, err := ks.findAddressAuth("test.cli.expired.console.1"); err != ErrNotFound {
+		t.Errorf("expired registration not deleted --> %v", err)
+	}
+
+	// Source is locked after max attempts, even with a valid code
+	for idx := 0; idx < 2; idx++ {
+		if err := ks.activateAddress("WRONG1", "ws:attacker"); err != ErrNotFound {
+			t.Errorf("wrong code activation = %v, want ErrNotFound", err)
+		}
+	}
+	if err := ks.activateAddress("FIRST1", "ws:attacker"); err != ErrActivationLocked {
+		t.Errorf("locked source activation = %v, want ErrActivationLocked", err)
+	}
+
+	// Code is single use
+	if err := ks.activateAddress("FIRST1", "telegram:1"); err != nil {
+		t.Errorf("valid code activation = %v", err)
+	}
+	if err := ks.activateAddress("FIRST1", "telegram:1"); err != ErrNotFound {
+		t.Errorf("second activation = %v, want ErrNotFound", err)
+	}
+	if auth, _ := ks.findAddressAuth("test.cli.first.console.1"); !auth.Enabled {
+		t.Error("address not enabled")
+	}
+}
+
+func TestActivationSource(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Activation = ConfActivation{Lifetime: 60, MaxAttempts: 2, Lockout: 60}
+	})
+	hash, _ := hashSecret("GOOD01")
+	_ = ks.db.UpsertAddressAuth(AddressAuth{AddressAuth: kite.AddressAuth{Name: "test.cli.pending.*.*", ActivationCode: hash}, ActivationTime: time.Now()})
+
+	// Rotating id of an authorized address doesn't reset failed attempts
+	for idx := 0; idx < 3; idx++ {
+		c := connect(t, ks, srv, fmt.Sprintf("test.cli.admin.console.%d", idx), testAdminKey)
+		c.send(t, kite.A_ACTIVATE, ks.config().Address, "WRONG1")
+		c.expect(t, A_ERROR)
+	}
+	c := connect(t, ks, srv, "test.cli.admin.console.9", testAdminKey)
+	c.send(t, kite.A_ACTIVATE, ks.config().Address, "GOOD01")
+	if msg := c.expect(t, A_ERROR); !strings.Contains(fmt.Sprint(msg.Data), ErrActivationLocked.Error()) {
+		t.Errorf("got %v, want activation locked", msg.Data)
+	}
+
+	// Telegram updates from another chat are ignored
+	ks.setTelegram(TmeConf{ChatId: 42})
+	body := `{"update_id": 1, "message": {"chat": {"id": 7}, "text": "activate:GOOD01"}}`
+	ks.telegramReceiver(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/telegram", strings.NewReader(body)))
+	if auth, _ := ks.findAddressAuth("test.cli.pending.console.1"); auth.Enabled {
+		t.Error("address activated from unknown Telegram chat")
+	}
+}
+
+// TestRegistrationLockout check remote host registering too many unknown addresses is locked out before any pending
+// authorization is created
+func TestRegistrationLockout(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Activation = ConfActivation{Lifetime: 60, MaxAttempts: 2, Lockout: 60}
+	})
+
+	for idx := 0; idx < 3; idx++ {
+		name := fmt.Sprintf("test.cli.newcomer%d.console.1", idx)
+		_, msg, err := dial(t, srv, name, "newcomer-api-key-0001")
+		want := E_ACTIVATION_REQUIRED
+		if idx == 2 {
+			want = E_ACTIVATION_FAILED
+		}
+		if err != nil || errorCode(msg) != want {
+			t.Errorf("registration %d got %s %v (%v), want %s", idx, msg.Action, msg.Data, err, want)
+		}
+		if _, err := ks.findAddressAuth(name); (err == nil) != (idx < 2) {
+			t.Errorf("pending authorization of registration %d --> %v", idx, err)
+		}
+	}
+}
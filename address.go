@@ -1,12 +1,12 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	kite "github.com/get-code-ch/kite-common"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/mongo"
 	"log"
 	"sync"
 	"time"
@@ -16,8 +16,25 @@ type (
 	AddressObs struct {
 		kite.Observer
 		address kite.Address
+		acl     []AclRule
+		auth    string
 		conn    *websocket.Conn
 		sync    sync.Mutex
+
+		// Negotiated protocol version and features, messages are sent CBOR encoded in binary frames when binary is set
+		version  int
+		features []string
+		binary   bool
+
+		// Connection context is canceled when connection ends, ending goroutines serving address
+		ctx            context.Context
+		cancel         context.CancelFunc
+		writeTimeout   time.Duration
+		maxMessageSize int64
+
+		// Presence subscriptions, guarded by watch (sync is held while writing)
+		watch         sync.Mutex
+		subscriptions []kite.Address
 	}
 )
 
@@ -27,6 +44,8 @@ func NewAddressObs(conn *websocket.Conn, ks *KiteServer) (*AddressObs, error) {
 
 	o := &AddressObs{}
 	o.conn = conn
+	o.writeTimeout = ks.config().Websocket.writeTimeout()
+	o.maxMessageSize = ks.config().Websocket.maxMessageSize()
 
 	// Setting max delay to receive a new registration message
 	_ = o.conn.SetReadDeadline(time.Now().Add(1 * time.Minute))
@@ -35,17 +54,14 @@ func NewAddressObs(conn *websocket.Conn, ks *KiteServer) (*AddressObs, error) {
 	o.sync.Lock()
 	defer o.sync.Unlock()
 
-	// Get address registration
-	if err := o.conn.ReadJSON(&msg); err == nil {
+	// Get address registration, client registering with a binary frame uses CBOR encoding
+	binary, err := o.read(&msg)
+	o.binary = binary
+	if err == nil {
 		// at this point client is not registered, we accept only register action message
 		if msg.Action != kite.A_REGISTER {
-			data := make(map[string]string)
-			data["Message"] = "invalid action, must be register"
-			if closeMessage, err := json.Marshal(kite.Message{Sender: ks.conf.Address, Receiver: o.address, Action: kite.A_REJECTED, Data: data}); err != nil {
-				_ = o.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(10*time.Second))
-			} else {
-				_ = o.conn.Close()
-			}
+			e := ErrorReply{Code: E_INVALID_ACTION, Message: "invalid action, must be register"}
+			o.reject(ks, e)
 			return nil, errors.New("address registration invalid message")
 		} else {
 			// Configuring address information
@@ -70,61 +86,117 @@ func NewAddressObs(conn *websocket.Conn, ks *KiteServer) (*AddressObs, error) {
 				o.address.Domain = "*"
 			}
 
+			// Negotiating protocol version and features
+			data, err := decodePayload(msg.Action, msg.Data)
+			if err != nil {
+				o.reject(ks, ErrorReply{Code: E_INVALID_PAYLOAD, Message: err.Error(), Details: err})
+				return nil, err
+			}
+			registration, _ := data.(Registration)
+			if o.version, o.features, err = negotiate(registration, o.conn.Subprotocol()); err != nil {
+				o.reject(ks, err.(ErrorReply))
+				return nil, err
+			}
+			o.binary = o.binary || o.supports(F_CBOR)
+			apiKey := registration.ApiKey
+
+			// Checking registered address is covered by client certificate identity
+			if ks.config().Ssl && ks.config().Cert.ClientAuth {
+				if err := o.checkCertificate(); err != nil {
+					o.reject(ks, ErrorReply{Code: E_CERTIFICATE, Message: err.Error()})
+					return nil, err
+				}
+			}
+
 			// Checking if address is authorized (api key and enabled)
-			if !ks.conf.SetupMode {
+			if !ks.config().SetupMode {
 				authorized := false
 
 				if addressAuth, err := ks.findAddressAuth(o.address.String()); err == nil {
-					authorized = msg.Data.(string) == addressAuth.ApiKey && addressAuth.Enabled
+					authorized = addressAuth.Enabled && checkSecret(addressAuth.ApiKey, apiKey)
+					o.acl = addressAuth.Acl
+					o.auth = addressAuth.Name
 				} else {
-					if err == mongo.ErrNoDocuments && len(msg.Data.(string)) > 10 {
-						addressAuth = kite.AddressAuth{}
+					if err == ErrNotFound && len(apiKey) > 10 {
+						// Registrations of unknown addresses count as failed activation attempts of remote host, a locked
+						// out host can't make server hash secrets nor send Telegram messages
+						source := registrationSource(o.conn.RemoteAddr())
+						if ks.activationLocked(source) {
+							e := ErrorReply{Code: E_ACTIVATION_FAILED, Message: ErrActivationLocked.Error()}
+							o.reject(ks, e)
+							return nil, e
+						}
+						ks.activationFailed(source)
+
+						addressAuth = AddressAuth{}
 						addressAuth.Enabled = false
 
+						// Authorization is given for any id, authorizations are looked up by address with any id (see
+						// addressAuthPattern) so a record named with client id would never be found nor activated.
 						// If host type is endpoint we creating authorization for host only
+						authAddress := o.address
+						authAddress.Id = "*"
 						if o.address.Type == kite.H_ENDPOINT {
-							o.address.Address = "*"
-							o.address.Id = "*"
+							authAddress.Address = "*"
 						}
 
-						addressAuth.Name = o.address.String()
-						addressAuth.ApiKey = msg.Data.(string)
-						addressAuth.ActivationCode = kite.RandomString(6)
+						// Api key and activation code are stored hashed
+						activationCode := kite.RandomString(6)
+						addressAuth.Name = authAddress.String()
+						addressAuth.ActivationTime = time.Now()
+						if addressAuth.ApiKey, err = hashSecret(apiKey); err != nil {
+							return nil, err
+						}
+						if addressAuth.ActivationCode, err = hashSecret(activationCode); err != nil {
+							return nil, err
+						}
 						if err := ks.upsertAddressAuth(addressAuth); err == nil {
-							data := make(map[string]string)
-							data["Message"] = fmt.Sprintf("new address %s try to connect server, activation code %s", addressAuth.Name, addressAuth.ActivationCode)
-							ks.sendToTelegram(data["Message"])
-							ks.address.Notify(kite.Event{Data: data["Message"]}, new(AddressObs), kite.Address{Domain: "*", Type: "*", Host: "*", Address: "*", Id: "*"})
-							return nil, errors.New(data["Message"])
+							// Activation code is sent to Telegram only, connected addresses must not learn it, without Telegram
+							// it is written to server log for administrator
+							notice := fmt.Sprintf("new address %s try to connect server, activation code %s", addressAuth.Name, activationCode)
+							if ks.telegram() == (TmeConf{}) {
+								log.Printf("Telegram bot not configured, %s", notice)
+							} else {
+								ks.sendToTelegram(notice)
+							}
+							message := fmt.Sprintf("address %s is waiting activation", addressAuth.Name)
+							o.reject(ks, ErrorReply{Code: E_ACTIVATION_REQUIRED, Message: message})
+							return nil, errors.New(message)
 						}
 					}
 				}
 
 				if !authorized {
-					data := make(map[string]string)
-					data["Message"] = "unauthorized address connection"
-					if closeMessage, err := json.Marshal(kite.Message{Sender: ks.conf.Address, Receiver: o.address, Action: kite.A_REJECTED, Data: data}); err != nil {
-						_ = o.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(10*time.Second))
-					} else {
-						_ = o.conn.Close()
-					}
-					return nil, errors.New(data["Message"])
+					e := ErrorReply{Code: E_UNAUTHORIZED, Message: "unauthorized address connection"}
+					o.reject(ks, e)
+					return nil, e
 				}
 			}
 		}
-		// If everything is Ok, sending accept message
-		data := make(map[string]string)
-		if ks.conf.SetupMode {
+		// Duplicate session is rejected before being accepted, register checks again while adding observer
+		if ks.config().sessionPolicy() == P_REJECT && ks.session(o.address) != nil {
+			log.Printf("Session of %s from %s rejected --> address already connected", o.address, o.conn.RemoteAddr())
+			e := ErrorReply{Code: E_DUPLICATE_SESSION, Message: fmt.Sprintf("address %s already connected", o.address)}
+			o.reject(ks, e)
+			return nil, e
+		}
+
+		// If everything is Ok, sending accept message with negotiated protocol
+		data := make(map[string]interface{})
+		if ks.config().SetupMode {
 			data["Message"] = "setup mode"
 		} else {
 			data["Message"] = "welcome " + o.address.String()
 		}
-		if err := o.conn.WriteJSON(kite.Message{Sender: ks.conf.Address, Receiver: o.address, Action: kite.A_ACCEPTED, Data: data}); err != nil {
+		data["Version"] = o.version
+		data["Features"] = o.features
+		if err := o.send(kite.Message{Sender: ks.config().Address, Receiver: o.address, Action: kite.A_ACCEPTED, Data: data}); err != nil {
 			err = errors.New("error accepting client " + err.Error())
 			_ = o.conn.Close()
 			return nil, err
 		}
 		// Everything is Ok, we return observable object
+		o.ctx, o.cancel = context.WithCancel(context.Background())
 		return o, nil
 	} else {
 		_ = o.conn.Close()
@@ -132,23 +204,64 @@ func NewAddressObs(conn *websocket.Conn, ks *KiteServer) (*AddressObs, error) {
 	}
 }
 
+// checkCertificate function verify address against identity of client certificate
+func (o *AddressObs) checkCertificate() error {
+	tlsConn, ok := o.conn.UnderlyingConn().(*tls.Conn)
+	if !ok || len(tlsConn.ConnectionState().PeerCertificates) == 0 {
+		return errors.New("client certificate required")
+	}
+	identity, err := certificateAddress(tlsConn.ConnectionState().PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+	if !o.address.Match(identity) {
+		return fmt.Errorf("address %s doesn't match certificate identity %s", o.address, identity)
+	}
+	return nil
+}
+
+// reject function send error message to not registered client and close connection
+// (error message is too large to be sent as close frame payload)
+func (o *AddressObs) reject(ks *KiteServer, e ErrorReply) {
+	_ = o.send(o.errorMessage(ks.config().Address, e))
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, e.Message)
+	_ = o.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(10*time.Second))
+	_ = o.conn.Close()
+}
+
+// write function send message to address, connection is not safe for concurrent writes
+func (o *AddressObs) write(msg interface{}) error {
+	o.sync.Lock()
+	defer o.sync.Unlock()
+	return o.send(msg)
+}
+
+// ping function send ping control frame to address, control frames can be written concurrently with messages
+func (o *AddressObs) ping(payload string) error {
+	return o.conn.WriteControl(websocket.PingMessage, []byte(payload), time.Now().Add(o.writeTimeout))
+}
+
 func (o *AddressObs) OnNotify(e kite.Event, sender kite.Observer, receiver kite.Address) {
 	if o.address.Match(receiver) {
 		msg := kite.Message{Data: e.Data, Action: e.Action, Sender: sender.(*AddressObs).address, Receiver: receiver}
 
-		o.sync.Lock()
-		defer o.sync.Unlock()
-		if err := o.conn.WriteJSON(msg); err != nil {
+		if err := o.write(msg); err != nil {
 			log.Printf("Error sending message to %s", receiver)
 		}
 	}
 }
 
-//goland:noinspection GoUnusedParameter
+// OnClose function send close frame to address, event data is the close reason
 func (o *AddressObs) OnClose(e kite.Event) {
 	o.sync.Lock()
 	defer o.sync.Unlock()
-	if err := o.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(1*time.Second)); err != nil {
+	reason := fmt.Sprint(e.Data)
+	// Close reason is limited to 123 bytes by control frame size
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	if err := o.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(1*time.Second)); err != nil {
 		log.Printf("Error closing connection --> %v", err)
 	}
 }
@@ -7,45 +7,69 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 type ServerConf struct {
-	ApiKey           string          `json:"api_key"`
+	ApiKey           string          `json:"api_key" conf:"secret"`
 	Server           string          `json:"server"`
 	Port             string          `json:"port"`
 	CheckOrigin      bool            `json:"check_origin"`
 	Ssl              bool            `json:"ssl"`
 	Cert             ConfCertificate `json:"cert,omitempty"`
 	TelegramConf     string          `json:"telegram_conf"`
+	Telegram         TmeConf         `json:"telegram,omitempty"`
 	Address          kite.Address    `json:"address"`
 	SetupMode        bool            `json:"setup_mode"`
+	SetupRoot        string          `json:"setup_root"`
+	DatabaseDriver   string          `json:"database_driver"`
 	DatabaseServer   string          `json:"database_server"`
 	DatabaseName     string          `json:"database_name"`
 	DatabaseUsername string          `json:"database_username"`
-	DatabasePassword string          `json:"database_password"`
+	DatabasePassword string          `json:"database_password" conf:"secret"`
+	DatabaseFile     string          `json:"database_file"`
+	Outbox           ConfOutbox      `json:"outbox,omitempty"`
+	Delivery         ConfDelivery    `json:"delivery,omitempty"`
+	CommandTimeout   int             `json:"command_timeout"`
+	Activation       ConfActivation  `json:"activation,omitempty"`
+	LogFile          string          `json:"log_file"`
+	ShutdownTimeout  int             `json:"shutdown_timeout"`
+	Heartbeat        ConfHeartbeat   `json:"heartbeat,omitempty"`
+	Websocket        ConfWebsocket   `json:"websocket,omitempty"`
+	SessionPolicy    string          `json:"session_policy"`
 }
 
 type ConfCertificate struct {
-	SslKey  string `json:"ssl_key"`
-	SslCert string `json:"ssl_cert,"`
+	SslKey     string `json:"ssl_key"`
+	SslCert    string `json:"ssl_cert,"`
+	ClientAuth bool   `json:"client_auth"`
+	ClientCa   string `json:"client_ca"`
+	Crl        string `json:"crl"`
 }
 
+// ConfigError is the list of problems found in configuration
+type ConfigError []string
+
+const checkConfigMode = "check-config"
 const defaultConfigFile = "./config/default.json"
 const setupConfigFile = "./config/setup.json"
 
-func loadConfig(configFile string) *ServerConf {
-
-	// New config creation
-	c := new(ServerConf)
-
+// configFileName function return configuration file given on command line or else default one
+func configFileName(configFile string) string {
 	// If no config file is provided we use "hardcoded" default filepath
-	if len(os.Args) >= 2 && configFile == "" {
-		configFile = os.Args[1]
-	}
-
 	if configFile == "" {
 		configFile = defaultConfigFile
 	}
+	return configFile
+}
+
+func loadConfig(configFile string) *ServerConf {
+
+	// New config creation
+	c := new(ServerConf)
+	configFile = configFileName(configFile)
 
 	// Testing if config file exist if not, loading setup file and if not exist, return a fatal error
 	if _, err := os.Stat(configFile); err != nil {
@@ -62,22 +86,204 @@ func loadConfig(configFile string) *ServerConf {
 		}
 	}
 
-	// Reading and parsing configuration file
-	if buffer, err := ioutil.ReadFile(configFile); err != nil {
-		log.Printf(fmt.Sprintf("Error reading config file --> %v", err))
+	// Reading, parsing and validating configuration file
+	c, err := readConfig(configFile)
+	if err != nil {
+		log.Printf("Error loading config file %s --> %v", configFile, err)
 		return nil
-	} else {
-		if err := json.Unmarshal(buffer, c); err != nil {
-			log.Printf(fmt.Sprintf("Error parsing config file --> %v", err))
+	}
+	return c
+}
+
+// readConfig function read, parse, override (environment and command line) and validate configuration file
+func readConfig(configFile string) (*ServerConf, error) {
+	buffer, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseConfig(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.applyOverrides(os.LookupEnv, commandLine); err != nil {
+		return nil, err
+	}
+	if err := c.validate(ioutil.ReadFile); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseConfig function parse configuration file content
+func parseConfig(buffer []byte) (*ServerConf, error) {
+	c := new(ServerConf)
+	if err := json.Unmarshal(buffer, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validate function check configuration and return all problems found, files referenced by configuration
+// are read with readFile
+func (c *ServerConf) validate(readFile func(string) ([]byte, error)) error {
+	var problems ConfigError
+
+	// checkFile function check a required file referenced by field can be read
+	checkFile := func(field string, file string) []byte {
+		if file == "" {
+			problems = append(problems, field+": missing")
 			return nil
 		}
-		return c
+		content, err := readFile(file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", field, err))
+		}
+		return content
+	}
+
+	if port, err := strconv.Atoi(c.Port); c.Port == "" {
+		problems = append(problems, "port: missing")
+	} else if err != nil || port < 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: invalid port %q", c.Port))
+	}
+
+	if c.Ssl {
+		checkFile("cert.ssl_cert", c.Cert.SslCert)
+		checkFile("cert.ssl_key", c.Cert.SslKey)
+		if c.Cert.ClientAuth {
+			checkFile("cert.client_ca", c.Cert.ClientCa)
+			if c.Cert.Crl != "" {
+				checkFile("cert.crl", c.Cert.Crl)
+			}
+		}
+	}
+
+	switch strings.ToLower(c.SessionPolicy) {
+	case "", P_KICK, P_REJECT, P_ALLOW:
+		break
+	default:
+		problems = append(problems, fmt.Sprintf("session_policy: unknown policy %q", c.SessionPolicy))
+	}
+
+	if c.SetupMode {
+		if c.ApiKey == "" {
+			problems = append(problems, "api_key: missing, required in setup mode")
+		}
+	} else {
+		if c.Address.Domain == "" || c.Address.Type == "" || c.Address.Host == "" {
+			problems = append(problems, "address: domain, type and host are required")
+		}
+
+		// Telegram is optional, it can be configured by file or directly (overridden by environment or command line)
+		if c.TelegramConf != "" {
+			if content := checkFile("telegram_conf", c.TelegramConf); content != nil {
+				if err := json.Unmarshal(content, &TmeConf{}); err != nil {
+					problems = append(problems, fmt.Sprintf("telegram_conf: %v", err))
+				}
+			}
+		}
+
+		switch strings.ToLower(c.DatabaseDriver) {
+		case "", D_MONGO:
+			if c.DatabaseServer == "" {
+				problems = append(problems, "database_server: missing")
+			}
+			if c.DatabaseName == "" {
+				problems = append(problems, "database_name: missing")
+			}
+			break
+		case D_BOLT, D_MEMORY:
+			break
+		default:
+			problems = append(problems, fmt.Sprintf("database_driver: unknown driver %q", c.DatabaseDriver))
+		}
+	}
+
+	for field, value := range map[string]int{
+		"outbox.ttl":                  c.Outbox.Ttl,
+		"outbox.size":                 c.Outbox.Size,
+		"delivery.retries":            c.Delivery.Retries,
+		"delivery.timeout":            c.Delivery.Timeout,
+		"command_timeout":             c.CommandTimeout,
+		"activation.lifetime":         c.Activation.Lifetime,
+		"activation.max_attempts":     c.Activation.MaxAttempts,
+		"activation.lockout":          c.Activation.Lockout,
+		"shutdown_timeout":            c.ShutdownTimeout,
+		"heartbeat.flap_window":       c.Heartbeat.FlapWindow,
+		"heartbeat.flap_limit":        c.Heartbeat.FlapLimit,
+		"websocket.ping_interval":     c.Websocket.PingInterval,
+		"websocket.pong_timeout":      c.Websocket.PongTimeout,
+		"websocket.write_timeout":     c.Websocket.WriteTimeout,
+		"websocket.read_buffer_size":  c.Websocket.ReadBufferSize,
+		"websocket.write_buffer_size": c.Websocket.WriteBufferSize,
+		"websocket.compression_level": c.Websocket.CompressionLevel,
+		"websocket.max_message_size":  c.Websocket.MaxMessageSize,
+	} {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s: must not be negative", field))
+		}
+	}
+
+	if c.Websocket.CompressionLevel > maxCompressionLevel {
+		problems = append(problems, fmt.Sprintf("websocket.compression_level: must be between 1 and %d", maxCompressionLevel))
+	}
+
+	for idx, rule := range c.Heartbeat.Rules {
+		if rule.Address == "" {
+			problems = append(problems, fmt.Sprintf("heartbeat.rules[%d].address: missing", idx))
+		}
+		if rule.Grace < 0 {
+			problems = append(problems, fmt.Sprintf("heartbeat.rules[%d].grace: must not be negative", idx))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
 	}
+	sort.Strings(problems)
+	return problems
+}
+
+// Error function list all configuration problems
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// checkConfig function validate configuration files given to check-config mode, return process exit code
+func checkConfig(configFiles []string) int {
+	if len(configFiles) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: kite-server check-config <file>...\n")
+		return 2
+	}
+
+	code := 0
+	for _, configFile := range configFiles {
+		if _, err := readConfig(configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+			code = 1
+		} else {
+			fmt.Printf("%s: ok\n", configFile)
+		}
+	}
+	return code
+}
+
+// config function return current configuration, configuration is replaced when reloaded
+func (ks *KiteServer) config() ServerConf {
+	ks.settings.RLock()
+	defer ks.settings.RUnlock()
+	return ks.conf
+}
+
+func (ks *KiteServer) setConfig(conf ServerConf) {
+	ks.settings.Lock()
+	defer ks.settings.Unlock()
+	ks.conf = conf
 }
 
-// TODO Create Stringer interface to return human readable config content
+// String function return effective configuration with secrets masked
 func (c *ServerConf) String() string {
-	if jsonConf, err := json.Marshal(c); err == nil {
+	if jsonConf, err := json.Marshal(c.masked()); err == nil {
 		return fmt.Sprintf("Server configuration -> %s", jsonConf)
 	} else {
 		return fmt.Sprintf("Error jsonify configuration -> %v", err)
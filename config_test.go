@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	telegram := filepath.Join(dir, "telegram.json")
+	_ = ioutil.WriteFile(telegram, []byte(`{"bot_id": "bot", "chat_id": 1}`), 0600)
+
+	valid := filepath.Join(dir, "valid.json")
+	_ = ioutil.WriteFile(valid, []byte(`{"port": "4433", "address": {"domain": "test", "type": "server", "host": "kite"},
+		"telegram_conf": "`+telegram+`", "database_driver": "bolt"}`), 0600)
+	if _, err := readConfig(valid); err != nil {
+		t.Errorf("valid configuration --> %v", err)
+	}
+
+	invalid := filepath.Join(dir, "invalid.json")
+	_ = ioutil.WriteFile(invalid, []byte(`{"ssl": true, "cert": {"ssl_cert": "`+filepath.Join(dir, "missing.crt")+`"},
+		"telegram_conf": "`+filepath.Join(dir, "missing.json")+`", "database_driver": "redis", "outbox": {"ttl": -1}, "session_policy": "drop",
+		"websocket": {"compression_level": 12}}`), 0600)
+	_, err := readConfig(invalid)
+	problems, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("invalid configuration --> %v, want ConfigError", err)
+	}
+	for _, field := range []string{"address", "cert.ssl_cert", "cert.ssl_key", "database_driver", "outbox.ttl", "port", "session_policy", "telegram_conf", "websocket.compression_level"} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, field+":")
+		}
+		if !found {
+			t.Errorf("no problem reported for %s in %v", field, problems)
+		}
+	}
+
+	// Shipped examples are valid, Telegram is optional
+	for _, example := range []string{"default.json", "standalone.json", "setup.json"} {
+		if _, err := readConfig(filepath.Join("examples", "config", example)); err != nil {
+			t.Errorf("example %s --> %v", example, err)
+		}
+	}
+
+	setup := filepath.Join(dir, "setup.json")
+	_ = ioutil.WriteFile(setup, []byte(`{"setup_mode": true, "port": "9443"}`), 0600)
+	if _, err := readConfig(setup); err == nil || !strings.Contains(err.Error(), "api_key: missing") {
+		t.Errorf("setup configuration without api key --> %v", err)
+	}
+
+	// check-config mode exit code
+	null, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer null.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = null, null
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	if code := checkConfig([]string{valid}); code != 0 {
+		t.Errorf("check-config of valid configuration exit %d", code)
+	}
+	if code := checkConfig([]string{valid, invalid}); code != 1 {
+		t.Errorf("check-config of invalid configuration exit %d", code)
+	}
+	if code := checkConfig(nil); code != 2 {
+		t.Errorf("check-config without file exit %d", code)
+	}
+}
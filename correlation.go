@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	// Requests hold commands waiting a reply from device, indexed by correlation id generated by server, so
+	// originators choosing the same id don't get each other's reply
+	Requests struct {
+		sync    sync.Mutex
+		pending map[string]*pendingRequest
+	}
+
+	// pendingRequest originator is a connected address or Telegram chat when origin is nil
+	pendingRequest struct {
+		origin  *AddressObs
+		command Envelope
+		timer   *time.Timer
+	}
+)
+
+const defaultCommandTimeout = 30
+
+// telegramAddress is the sender of messages coming from Telegram chat
+var telegramAddress = kite.Address{Domain: "telegram", Type: kite.H_ANY, Host: "*", Address: "*", Id: "*"}
+
+// trackRequest function register command to route reply back to its origin, command is sent with a server
+// correlation id, the originator one (set if missing) is restored on reply
+func (ks *KiteServer) trackRequest(command *Envelope, origin *AddressObs) {
+	id := newMessageId()
+	if command.CorrelationId == "" {
+		command.CorrelationId = id
+	}
+	timeout := ks.config().CommandTimeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+
+	tracked := *command
+	command.CorrelationId = id
+	ks.requests.sync.Lock()
+	defer ks.requests.sync.Unlock()
+	ks.requests.pending[id] = &pendingRequest{
+		origin:  origin,
+		command: tracked,
+		timer:   time.AfterFunc(time.Duration(timeout)*time.Second, func() { ks.expireRequest(id) }),
+	}
+}
+
+// resolveRequest function route reply to command originator, return false if message isn't a reply to a pending command
+func (ks *KiteServer) resolveRequest(reply Envelope) bool {
+	if reply.CorrelationId == "" {
+		return false
+	}
+
+	ks.requests.sync.Lock()
+	p, ok := ks.requests.pending[reply.CorrelationId]
+	// Only commanded device can answer
+	if ok && reply.Sender.Match(p.command.Receiver) {
+		p.timer.Stop()
+		delete(ks.requests.pending, reply.CorrelationId)
+	} else {
+		ok = false
+	}
+	ks.requests.sync.Unlock()
+	if !ok {
+		return false
+	}
+
+	if p.origin == nil {
+		ks.sendToTelegram(fmt.Sprintf("%s reply from %s --> %v", p.command.Data, reply.Sender, reply.Data))
+		return true
+	}
+	reply.Receiver = p.origin.address
+	reply.CorrelationId = p.command.CorrelationId
+	if err := p.origin.write(reply); err != nil {
+		log.Printf("Error sending reply %s to %s --> %v", reply.CorrelationId, p.origin.address, err)
+	}
+	return true
+}
+
+// expireRequest function notify originator that command didn't get any reply
+func (ks *KiteServer) expireRequest(id string) {
+	ks.requests.sync.Lock()
+	p, ok := ks.requests.pending[id]
+	delete(ks.requests.pending, id)
+	ks.requests.sync.Unlock()
+	if !ok {
+		return
+	}
+
+	message := fmt.Sprintf("command %v to %s timed out", p.command.Data, p.command.Receiver)
+	log.Printf("Command %s from %s timed out", id, p.command.Sender)
+	if p.origin == nil {
+		ks.sendToTelegram(message)
+		return
+	}
+
+	ks.replyError(p.origin, p.command, ErrorReply{Code: E_COMMAND_TIMEOUT, Message: message})
+}
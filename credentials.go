@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/subtle"
+	"golang.org/x/crypto/bcrypt"
+	"log"
+	"time"
+)
+
+// hashSecret function return bcrypt hash of api key or activation code
+func hashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isHashed function check if stored value is a bcrypt hash
+func isHashed(value string) bool {
+	_, err := bcrypt.Cost([]byte(value))
+	return err == nil
+}
+
+// checkSecret function compare secret with stored value in constant time, plaintext stored value are still accepted,
+// nothing matches a secret which isn't configured
+func checkSecret(stored string, secret string) bool {
+	if stored == "" {
+		return false
+	}
+	if isHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(secret)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) == 1
+}
+
+// migrateSecrets function hash api keys and activation codes still stored in plaintext
+func (ks *KiteServer) migrateSecrets() {
+	addressAuths, err := ks.store().ListAddressAuth()
+	if err != nil {
+		log.Printf("Error reading address authorizations --> %v", err)
+		return
+	}
+
+	for _, addressAuth := range addressAuths {
+		migrated := false
+		if addressAuth.ApiKey != "" && !isHashed(addressAuth.ApiKey) {
+			if addressAuth.ApiKey, err = hashSecret(addressAuth.ApiKey); err != nil {
+				log.Printf("Error hashing api key of %s --> %v", addressAuth.Name, err)
+				continue
+			}
+			migrated = true
+		}
+		// Pending registrations of previous versions have no creation time, lifetime start now
+		if addressAuth.ActivationCode != "" && addressAuth.ActivationTime.IsZero() {
+			addressAuth.ActivationTime = time.Now()
+			migrated = true
+		}
+		if addressAuth.ActivationCode != "" && !isHashed(addressAuth.ActivationCode) {
+			if addressAuth.ActivationCode, err = hashSecret(addressAuth.ActivationCode); err != nil {
+				log.Printf("Error hashing activation code of %s --> %v", addressAuth.Name, err)
+				continue
+			}
+			migrated = true
+		}
+		if migrated {
+			if err := ks.store().UpsertAddressAuth(addressAuth); err != nil {
+				log.Printf("Error migrating address authorization %s --> %v", addressAuth.Name, err)
+			} else {
+				log.Printf("Address authorization %s secrets hashed", addressAuth.Name)
+			}
+		}
+	}
+}
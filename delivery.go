@@ -0,0 +1,143 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	ConfDelivery struct {
+		Retries int `json:"retries"`
+		Timeout int `json:"timeout"`
+	}
+
+	// DeliveryReport is sent back to sender of a routed message
+	DeliveryReport struct {
+		Id       string       `json:"Id"`
+		Receiver kite.Address `json:"Receiver"`
+		Status   string       `json:"Status"`
+	}
+
+	// Deliveries hold routed messages waiting to be acknowledged by receivers
+	Deliveries struct {
+		sync    sync.Mutex
+		pending map[string]*pendingDelivery
+	}
+
+	pendingDelivery struct {
+		env      Envelope
+		sender   *AddressObs
+		receiver *AddressObs
+		attempts int
+		timer    *time.Timer
+	}
+)
+
+const (
+	// Delivery status definition
+	S_PENDING   = "pending"
+	S_DELIVERED = "delivered"
+	S_FAILED    = "failed"
+	S_QUEUED    = "queued"
+)
+
+func deliveryKey(id string, receiver kite.Address) string {
+	return id + "/" + receiver.String()
+}
+
+// trackDelivery function wait acknowledgement of message sent to receiver, tracking is enabled when retries are
+// configured and receiver negotiated delivery (legacy receivers never acknowledge)
+func (ks *KiteServer) trackDelivery(env Envelope, sender *AddressObs, receiver *AddressObs) {
+	if ks.config().Delivery.Retries <= 0 || !receiver.supports(F_DELIVERY) {
+		return
+	}
+
+	p := &pendingDelivery{env: env, sender: sender, receiver: receiver}
+	key := deliveryKey(env.Id, receiver.address)
+
+	ks.deliveries.sync.Lock()
+	ks.deliveries.pending[key] = p
+	p.timer = time.AfterFunc(ks.retryDelay(0), func() { ks.retryDelivery(key) })
+	ks.deliveries.sync.Unlock()
+
+	ks.reportDelivery(sender, env.Id, receiver.address, S_PENDING)
+}
+
+// retryDelivery function resend not acknowledged message, with exponential backoff, until retries are exhausted
+func (ks *KiteServer) retryDelivery(key string) {
+	ks.deliveries.sync.Lock()
+	p, ok := ks.deliveries.pending[key]
+	if !ok {
+		ks.deliveries.sync.Unlock()
+		return
+	}
+	p.attempts++
+	if p.attempts > ks.config().Delivery.Retries {
+		delete(ks.deliveries.pending, key)
+		ks.deliveries.sync.Unlock()
+		log.Printf("Message %s not acknowledged by %s", p.env.Id, p.receiver.address)
+		ks.reportDelivery(p.sender, p.env.Id, p.receiver.address, S_FAILED)
+		return
+	}
+	p.timer = time.AfterFunc(ks.retryDelay(p.attempts), func() { ks.retryDelivery(key) })
+	ks.deliveries.sync.Unlock()
+
+	if err := p.receiver.write(p.env); err != nil {
+		log.Printf("Error resending message %s to %s --> %v", p.env.Id, p.receiver.address, err)
+	}
+}
+
+// acknowledge function handle delivery acknowledgement from receiver
+func (ks *KiteServer) acknowledge(id string, receiver *AddressObs) {
+	key := deliveryKey(id, receiver.address)
+
+	ks.deliveries.sync.Lock()
+	p, ok := ks.deliveries.pending[key]
+	if ok {
+		p.timer.Stop()
+		delete(ks.deliveries.pending, key)
+	}
+	ks.deliveries.sync.Unlock()
+
+	if ok {
+		ks.reportDelivery(p.sender, id, receiver.address, S_DELIVERED)
+	}
+}
+
+// cancelDelivery function stop tracking message which couldn't be sent to receiver, sender isn't reported
+func (ks *KiteServer) cancelDelivery(id string, receiver *AddressObs) {
+	key := deliveryKey(id, receiver.address)
+
+	ks.deliveries.sync.Lock()
+	defer ks.deliveries.sync.Unlock()
+	if p, ok := ks.deliveries.pending[key]; ok {
+		p.timer.Stop()
+		delete(ks.deliveries.pending, key)
+	}
+}
+
+// reportDelivery function send delivery status of message to its sender, when sender negotiated delivery
+func (ks *KiteServer) reportDelivery(sender *AddressObs, id string, receiver kite.Address, status string) {
+	if ks.config().Delivery.Retries <= 0 || sender == nil || !sender.supports(F_DELIVERY) {
+		return
+	}
+	report := Envelope{Message: kite.Message{
+		Action:   A_DELIVERY,
+		Sender:   ks.config().Address,
+		Receiver: sender.address,
+		Data:     DeliveryReport{Id: id, Receiver: receiver, Status: status},
+	}}
+	if err := sender.write(report); err != nil {
+		log.Printf("Error sending delivery report to %s --> %v", sender.address, err)
+	}
+}
+
+func (ks *KiteServer) retryDelay(attempts int) time.Duration {
+	timeout := ks.config().Delivery.Timeout
+	if timeout <= 0 {
+		timeout = 10
+	}
+	return time.Duration(timeout) * time.Second << uint(attempts)
+}
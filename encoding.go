@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Feature enabling CBOR encoding of messages sent to address (websocket binary frames)
+const F_CBOR = "cbor"
+
+// cborMode encode floats in their shortest form, sensor readings are mostly small values
+var cborMode, _ = cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+
+// read function read next message of address, binary frames are CBOR encoded and text frames JSON encoded, so
+// messages are decoded the same way whatever encoding is used, return true if message was a binary frame.
+// Message larger than max size is not read and connection is closed
+func (o *AddressObs) read(v interface{}) (bool, error) {
+	messageType, r, err := o.conn.NextReader()
+	if err != nil {
+		return false, err
+	}
+	binary := messageType == websocket.BinaryMessage
+
+	// Reading one byte more than max size to detect oversized message (decompressed size if compression is used)
+	content, err := ioutil.ReadAll(io.LimitReader(r, o.maxMessageSize+1))
+	if err != nil {
+		return binary, err
+	}
+	if int64(len(content)) > o.maxMessageSize {
+		reason := fmt.Sprintf("message exceeds max size of %d bytes", o.maxMessageSize)
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseMessageTooBig, reason)
+		_ = o.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(o.writeTimeout))
+		return binary, errors.New(reason)
+	}
+
+	if binary {
+		return true, decodeCbor(content, v)
+	}
+	return false, json.Unmarshal(content, v)
+}
+
+// send function write message to address with its negotiated encoding, caller must hold address lock
+func (o *AddressObs) send(msg interface{}) error {
+	msg = o.outgoing(msg)
+	_ = o.conn.SetWriteDeadline(time.Now().Add(o.writeTimeout))
+	if !o.binary {
+		return o.conn.WriteJSON(msg)
+	}
+	content, err := encodeCbor(msg)
+	if err != nil {
+		return err
+	}
+	return o.conn.WriteMessage(websocket.BinaryMessage, content)
+}
+
+// decodeCbor function decode CBOR message through its JSON form, so payloads have the same types whatever encoding
+// sender uses (objects are string keyed maps, numbers are float64)
+func decodeCbor(content []byte, v interface{}) error {
+	var generic interface{}
+	if err := cbor.Unmarshal(content, &generic); err != nil {
+		return err
+	}
+	generic, err := jsonValue(generic)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, v)
+}
+
+// encodeCbor function encode message through its JSON form, so receivers get the same structure whatever their
+// encoding is (json tags, identifiers and times as strings)
+func encodeCbor(msg interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return cborMode.Marshal(cborValue(generic))
+}
+
+// jsonValue function convert decoded CBOR value to a value JSON can encode (maps have string keys)
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor map key %v is not a string", key)
+			}
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		for idx, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[idx] = converted
+		}
+		return v, nil
+	case cbor.Tag:
+		return jsonValue(v.Content)
+	}
+	return value, nil
+}
+
+// cborValue function convert JSON numbers to integers when possible, other values are left unchanged
+func cborValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = cborValue(item)
+		}
+		return v
+	case []interface{}:
+		for idx, item := range v {
+			v[idx] = cborValue(item)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+// sendCbor function send CBOR encoded message in a binary frame
+func (c *testClient) sendCbor(t *testing.T, action kite.Action, receiver kite.Address, data interface{}) {
+	t.Helper()
+	content, err := cbor.Marshal(map[string]interface{}{"Action": action, "Sender": c.address, "Receiver": receiver, "Data": data})
+	if err != nil {
+		t.Fatalf("encoding %s --> %v", action, err)
+	}
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, content); err != nil {
+		t.Fatalf("sending %s from %s --> %v", action, c.address, err)
+	}
+}
+
+// expectCbor function read next message, which must be a binary frame, and check its action
+func (c *testClient) expectCbor(t *testing.T, action kite.Action) map[interface{}]interface{} {
+	t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, content, err := c.conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("%s waiting %s --> %v", c.address, action, err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("%s got text frame %s, want binary %s", c.address, content, action)
+	}
+	var msg map[interface{}]interface{}
+	if err := cbor.Unmarshal(content, &msg); err != nil {
+		t.Fatalf("%s decoding %s --> %v", c.address, action, err)
+	}
+	if msg["Action"] != string(action) {
+		t.Fatalf("%s got %v action, want %s (data %v)", c.address, msg["Action"], action, msg["Data"])
+	}
+	return msg
+}
+
+func TestCborEncoding(t *testing.T) {
+	ks, srv := newTestServer(t)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	// Registering with a binary frame select CBOR encoding
+	iot := open(t, srv, testIotAddress)
+	iot.sendCbor(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testIotKey, Version: maxProtocolVersion, Capabilities: testCapabilities})
+	iot.expectCbor(t, kite.A_ACCEPTED)
+	iot.expectCbor(t, kite.A_PROVISION)
+	waitFor(t, "registration of "+testIotAddress, func() bool { return registered(ks, iot.address) })
+
+	// JSON client to CBOR client
+	browser.send(t, kite.A_NOTIFY, iot.address, map[string]interface{}{"switch": "on", "level": 0.5})
+	data, _ := iot.expectCbor(t, kite.A_NOTIFY)["Data"].(map[interface{}]interface{})
+	if data["switch"] != "on" || data["level"] != 0.5 {
+		t.Errorf("CBOR client got %v", data)
+	}
+
+	// CBOR client to JSON client, integers are numbers
+	iot.sendCbor(t, kite.A_NOTIFY, browser.address, map[string]interface{}{"temperature": 21, "unit": "C"})
+	msg := browser.expect(t, kite.A_NOTIFY)
+	if data, _ := msg.Data.(map[string]interface{}); data["temperature"] != 21.0 || data["unit"] != "C" || msg.Sender != iot.address {
+		t.Errorf("JSON client got %v from %s", msg.Data, msg.Sender)
+	}
+
+	// Malformed CBOR payload get an error in CBOR
+	iot.sendCbor(t, kite.A_LOG, ks.config().Address, 42)
+	if data, _ := iot.expectCbor(t, A_ERROR)["Data"].(map[interface{}]interface{}); data["Code"] != string(E_INVALID_PAYLOAD) {
+		t.Errorf("got error %v, want %s", data, E_INVALID_PAYLOAD)
+	}
+
+	// CBOR negotiated as a capability by JSON registration
+	admin := open(t, srv, testAdminAddress)
+	admin.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testAdminKey, Version: 2, Capabilities: []string{F_CBOR}})
+	accepted := admin.expectCbor(t, kite.A_ACCEPTED)
+	if data, _ := accepted["Data"].(map[interface{}]interface{}); data["Version"] != uint64(2) {
+		t.Errorf("accepted data %v", accepted["Data"])
+	}
+}
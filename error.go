@@ -0,0 +1,62 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+)
+
+type (
+	// ErrorCode is a stable machine readable error identifier, client can rely on it while messages can change
+	ErrorCode string
+
+	// ErrorReply is data of error message sent to client, Id is identifier of the failing message when known
+	ErrorReply struct {
+		Code    ErrorCode   `json:"Code"`
+		Id      string      `json:"Id,omitempty"`
+		Message string      `json:"Message"`
+		Details interface{} `json:"Details,omitempty"`
+	}
+)
+
+const (
+	// Error action, sent by server when a message can't be handled
+	A_ERROR kite.Action = "error"
+
+	// Error codes
+	E_INVALID_ACTION      ErrorCode = "invalid_action"
+	E_UNSUPPORTED_VERSION ErrorCode = "unsupported_version"
+	E_INVALID_PAYLOAD     ErrorCode = "invalid_payload"
+	E_UNAUTHORIZED        ErrorCode = "unauthorized"
+	E_CERTIFICATE         ErrorCode = "certificate_mismatch"
+	E_ACTIVATION_REQUIRED ErrorCode = "activation_required"
+	E_ACTIVATION_FAILED   ErrorCode = "activation_failed"
+	E_DUPLICATE_SESSION   ErrorCode = "duplicate_session"
+	E_FORBIDDEN           ErrorCode = "forbidden"
+	E_SETUP_MODE          ErrorCode = "setup_mode"
+	E_COMMAND_TIMEOUT     ErrorCode = "command_timeout"
+	E_FEATURE_REQUIRED    ErrorCode = "feature_required"
+)
+
+func (e ErrorReply) Error() string {
+	return e.Message
+}
+
+// replyError function send error message to address, reply is correlated with failing message
+func (ks *KiteServer) replyError(this *AddressObs, message Envelope, e ErrorReply) {
+	if e.Id == "" {
+		e.Id = message.Id
+	}
+	reply := Envelope{Message: this.errorMessage(ks.config().Address, e), CorrelationId: message.CorrelationId}
+	if err := this.write(reply); err != nil {
+		log.Printf("Error sending %s error to %s --> %v", e.Code, this.address, err)
+	}
+}
+
+// errorMessage function return error message understood by address, address which didn't negotiate errors feature
+// gets a legacy rejected message holding description only
+func (o *AddressObs) errorMessage(sender kite.Address, e ErrorReply) kite.Message {
+	if o.supports(F_ERRORS) {
+		return kite.Message{Action: A_ERROR, Sender: sender, Receiver: o.address, Data: e}
+	}
+	return kite.Message{Action: kite.A_REJECTED, Sender: sender, Receiver: o.address, Data: map[string]string{"Message": e.Message}}
+}
@@ -5,7 +5,10 @@ go 1.15
 replace github.com/get-code-ch/kite-common => D:/projects/kite-common
 
 require (
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/get-code-ch/kite-common v0.0.0-20201231061950-e6dc1eb25cb2
 	github.com/gorilla/websocket v1.4.2
+	go.etcd.io/bbolt v1.3.5
 	go.mongodb.org/mongo-driver v1.4.4
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 )
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	// ConfHeartbeat define addresses expected to stay connected, alerts are sent to Telegram when they don't
+	ConfHeartbeat struct {
+		Rules      []HeartbeatRule `json:"rules"`
+		FlapWindow int             `json:"flap_window"`
+		FlapLimit  int             `json:"flap_limit"`
+	}
+
+	// HeartbeatRule is an address pattern with the delay an address can stay offline before alerting
+	HeartbeatRule struct {
+		Address string `json:"address"`
+		Grace   int    `json:"grace"`
+	}
+
+	// Heartbeats hold alert state of addresses, notify send alerts (Telegram)
+	Heartbeats struct {
+		sync    sync.Mutex
+		started time.Time
+		states  map[string]*heartbeatState
+		notify  func(string)
+	}
+
+	heartbeatState struct {
+		alerted  bool
+		silenced bool
+		flapping bool
+		alerts   []time.Time
+	}
+)
+
+const (
+	defaultHeartbeatGrace      = 300
+	defaultHeartbeatFlapWindow = 3600
+	defaultHeartbeatFlapLimit  = 3
+
+	heartbeatCheckInterval = 30 * time.Second
+)
+
+// watchHeartbeats function check regularly addresses offline past their grace period until server stops
+func (ks *KiteServer) watchHeartbeats() {
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			ks.checkHeartbeats(now)
+			break
+		case <-ks.stopping:
+			return
+		}
+	}
+}
+
+// checkHeartbeats function alert once for each address matching a heartbeat rule and offline past its grace period,
+// addresses are not considered offline before server start
+func (ks *KiteServer) checkHeartbeats(now time.Time) {
+	conf := ks.config().Heartbeat
+	if len(conf.Rules) == 0 {
+		return
+	}
+
+	for _, presence := range ks.whoIsOnline(anyAddress) {
+		if presence.Online {
+			continue
+		}
+		rule, ok := heartbeatRule(conf, parseAddress(presence.Address))
+		if !ok {
+			continue
+		}
+
+		ks.heartbeats.sync.Lock()
+		since := presence.LastSeen
+		if since.Before(ks.heartbeats.started) {
+			since = ks.heartbeats.started
+		}
+		state := ks.heartbeats.state(presence.Address)
+		if state.alerted || now.Sub(since) < rule.grace() {
+			ks.heartbeats.sync.Unlock()
+			continue
+		}
+		state.alerted = true
+		message := ks.heartbeats.flap(state, presence.Address, now, conf)
+		silenced := state.silenced
+		ks.heartbeats.sync.Unlock()
+
+		if message == "" && !silenced {
+			message = fmt.Sprintf("%s is offline since %s", presence.Address, since.Format(time.RFC3339))
+		}
+		if message != "" {
+			log.Printf("Heartbeat alert --> %s", message)
+			ks.heartbeats.notify(message)
+		}
+	}
+}
+
+// recovered function send recovery notice when an address alerted as offline is connected again
+func (ks *KiteServer) recovered(presence Presence) {
+	ks.heartbeats.sync.Lock()
+	state, ok := ks.heartbeats.states[presence.Address]
+	if !ok || !state.alerted {
+		ks.heartbeats.sync.Unlock()
+		return
+	}
+	state.alerted = false
+	silenced := state.silenced
+	state.silenced = false
+	ks.heartbeats.sync.Unlock()
+
+	if !silenced {
+		message := fmt.Sprintf("%s is back online", presence.Address)
+		log.Printf("Heartbeat recovery --> %s", message)
+		ks.heartbeats.notify(message)
+	}
+}
+
+// flap function count alert of address and return a flapping notice the first time the limit is exceeded in flap
+// window, state is silenced while address is flapping (alert and recovery messages aren't sent)
+func (h *Heartbeats) flap(state *heartbeatState, address string, now time.Time, conf ConfHeartbeat) string {
+	window := time.Duration(conf.FlapWindow) * time.Second
+	if conf.FlapWindow <= 0 {
+		window = defaultHeartbeatFlapWindow * time.Second
+	}
+	limit := conf.FlapLimit
+	if limit <= 0 {
+		limit = defaultHeartbeatFlapLimit
+	}
+
+	alerts := state.alerts[:0]
+	for _, alert := range state.alerts {
+		if now.Sub(alert) < window {
+			alerts = append(alerts, alert)
+		}
+	}
+	state.alerts = append(alerts, now)
+
+	if len(state.alerts) <= limit {
+		state.flapping = false
+		state.silenced = false
+		return ""
+	}
+	state.silenced = true
+	if state.flapping {
+		return ""
+	}
+	state.flapping = true
+	return fmt.Sprintf("%s is flapping (%d alerts in %v), next alerts are suppressed", address, len(state.alerts), window)
+}
+
+func (h *Heartbeats) state(address string) *heartbeatState {
+	state, ok := h.states[address]
+	if !ok {
+		state = &heartbeatState{}
+		h.states[address] = state
+	}
+	return state
+}
+
+// heartbeatRule function return first rule matching address
+func heartbeatRule(conf ConfHeartbeat, address kite.Address) (HeartbeatRule, bool) {
+	for _, rule := range conf.Rules {
+		if address.Match(parseAddress(rule.Address)) {
+			return rule, true
+		}
+	}
+	return HeartbeatRule{}, false
+}
+
+func (r HeartbeatRule) grace() time.Duration {
+	if r.Grace <= 0 {
+		return defaultHeartbeatGrace * time.Second
+	}
+	return time.Duration(r.Grace) * time.Second
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestHeartbeat(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Heartbeat = ConfHeartbeat{Rules: []HeartbeatRule{{Address: "test.iot.*.*.*", Grace: 60}}, FlapLimit: 2}
+	})
+	var lock sync.Mutex
+	var alerts []string
+	ks.heartbeats.notify = func(message string) {
+		lock.Lock()
+		defer lock.Unlock()
+		alerts = append(alerts, message)
+	}
+	// expectAlerts function check alerts sent since previous call
+	expectAlerts := func(what string, want ...string) {
+		t.Helper()
+		lock.Lock()
+		defer lock.Unlock()
+		if len(alerts) != len(want) {
+			t.Fatalf("%s: got alerts %q, want %q", what, alerts, want)
+		}
+		for idx := range want {
+			if !strings.Contains(alerts[idx], want[idx]) {
+				t.Errorf("%s: got alert %q, want %q", what, alerts[idx], want[idx])
+			}
+		}
+		alerts = nil
+	}
+
+	// bounce function connect iot then disconnect it
+	bounce := func() {
+		t.Helper()
+		iot := connect(t, ks, srv, testIotAddress, testIotKey)
+		iot.expect(t, kite.A_PROVISION)
+		_ = iot.conn.Close()
+		waitFor(t, "iot offline", func() bool {
+			presences := ks.whoIsOnline(iot.address)
+			return len(presences) == 1 && !presences[0].Online
+		})
+	}
+
+	// Browser isn't watched
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	_ = browser.conn.Close()
+	bounce()
+
+	ks.checkHeartbeats(time.Now().Add(30 * time.Second))
+	expectAlerts("within grace period")
+
+	ks.checkHeartbeats(time.Now().Add(2 * time.Minute))
+	ks.checkHeartbeats(time.Now().Add(3 * time.Minute))
+	expectAlerts("past grace period", testIotAddress+" is offline")
+
+	bounce()
+	expectAlerts("recovery", testIotAddress+" is back online")
+
+	ks.checkHeartbeats(time.Now().Add(2 * time.Minute))
+	expectAlerts("second alert", "is offline")
+
+	// Third alert in flap window exceed limit, a single flapping notice is sent then alerts are suppressed
+	bounce()
+	ks.checkHeartbeats(time.Now().Add(2 * time.Minute))
+	expectAlerts("flapping", "back online", "is flapping")
+	bounce()
+	ks.checkHeartbeats(time.Now().Add(2 * time.Minute))
+	expectAlerts("suppressed")
+}
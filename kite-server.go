@@ -2,50 +2,63 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	kite "github.com/get-code-ch/kite-common"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/mongo"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"regexp"
 	"sync"
 	"time"
 )
 
 type KiteServer struct {
-	upgrader websocket.Upgrader
-	conn     *websocket.Conn
-	ctx      context.Context
-	db       *mongo.Database
-	address  kite.EventNotifier
-	conf     ServerConf
-	tme      TmeConf
-	srv      http.Server
-	mux      *http.ServeMux
-	wg       sync.WaitGroup
-	sync     sync.Mutex
+	conn       *websocket.Conn
+	ctx        context.Context
+	db         Store
+	database   sync.RWMutex
+	address    kite.EventNotifier
+	observers  sync.RWMutex
+	conf       ServerConf
+	tme        TmeConf
+	srv        *http.Server
+	mux        *http.ServeMux
+	handlers   sync.RWMutex
+	settings   sync.RWMutex
+	wg         sync.WaitGroup
+	deliveries Deliveries
+	requests   Requests
+	attempts   Attempts
+	presences  Presences
+	heartbeats Heartbeats
+	configFile string
+	restart    sync.Mutex
+	stopping   chan struct{}
+	stopped    chan struct{}
+	failed     bool
+	logFile    *os.File
 }
 
+// sendPing function ping address regularly until connection context is canceled, a pong must be received before
+// read deadline or connection is considered dead and closed by waitMessage
 func (ks *KiteServer) sendPing(this *AddressObs) {
 	defer ks.wg.Done()
-	sentinel := make(chan bool)
-
-	ticker := time.NewTicker(1 * time.Minute).C
+	ticker := time.NewTicker(ks.config().Websocket.pingInterval())
+	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker:
-			ks.sync.Lock()
-			if err := this.conn.WriteControl(websocket.PingMessage, []byte(fmt.Sprint(ks.conf.Address)), time.Now().Add(1*time.Second)); err != nil {
-				log.Printf("Error pinging peer --> %v", err)
-				ks.sync.Unlock()
-				ks.address.Deregister(this)
-				this.conn.Close()
+		case <-ticker.C:
+			if err := this.ping(fmt.Sprint(ks.config().Address)); err != nil {
+				// Closing connection ends waitMessage which deregister address and cancel connection context
+				log.Printf("Error pinging %s --> %v", this.address, err)
+				_ = this.conn.Close()
 				return
 			}
-			ks.sync.Unlock()
 			break
-		case <-sentinel:
+		case <-this.ctx.Done():
 			return
 		}
 	}
@@ -54,55 +67,115 @@ func (ks *KiteServer) sendPing(this *AddressObs) {
 func (ks *KiteServer) waitMessage(this *AddressObs) {
 
 	defer ks.wg.Done()
+	// Ending ping of address
+	defer this.cancel()
 
 	for {
-		message := kite.Message{}
-		if err := this.conn.ReadJSON(&message); err == nil {
-			if ks.conf.SetupMode {
+		message := Envelope{}
+		if _, err := this.read(&message); err == nil {
+			_ = this.conn.SetReadDeadline(ks.config().Websocket.readDeadline())
+			ks.seen(this)
+			// Sender is the registered address, whatever client claims
+			message.Sender = this.address
+			// Data is replaced by its decoded value, malformed messages are rejected
+			if data, err := decodePayload(message.Action, message.Data); err == nil {
+				message.Data = data
+			} else {
+				ks.rejectPayload(message, this, err)
+				continue
+			}
+			if ks.config().SetupMode {
 				if message.Action == kite.A_SETUP {
+					// Setup outcome is reported to client by setupServer
 					if err := ks.setupServer(message, this); err != nil {
-						ks.address.Notify(kite.Event{Data: fmt.Sprintf("Error provisioning setup -> %s", err)}, this, message.Sender)
 						log.Printf("Error provisioning setup from %s -> %s", message.Sender, err)
 					} else {
-						ks.address.Notify(kite.Event{Data: "Server setup successfully provisioned"}, this, message.Sender)
 						log.Printf("Server setup successfully provisioned from %s", message.Sender)
 					}
 				} else {
-					ks.address.Notify(kite.Event{Data: fmt.Sprintf("%s action rejected in setup mode", message.Action)}, this, message.Sender)
+					ks.replyError(this, message, ErrorReply{Code: E_SETUP_MODE, Message: fmt.Sprintf("%s action rejected in setup mode", message.Action)})
 					log.Printf("%s action ignored in setup mode", message.Action)
 				}
 			} else {
 				switch message.Action {
 				case kite.A_LOG:
-					log.Printf("Log message from %s : %s", message.Sender, message.Data.(string))
-					ks.writeLog(message.Data.(string), message.Sender)
+					log.Printf("Log message from %s : %s", message.Sender, payloadText(message.Data))
+					ks.writeLog(payloadText(message.Data), message.Sender)
 					break
 				case kite.A_READLOG:
-					if logs := ks.readLog(message.Data.(string)); logs != nil {
-						ks.address.Notify(kite.Event{Data: logs, Action: kite.A_LOG}, this, message.Sender)
+					// Logs are held by server, whatever receiver is given
+					if !ks.checkAcl(message, this, ks.config().Address) {
+						break
+					}
+					if logs := ks.readLog(payloadText(message.Data)); logs != nil {
+						if err := this.write(kite.Message{Action: kite.A_LOG, Sender: ks.config().Address, Receiver: this.address, Data: logs}); err != nil {
+							log.Printf("Error sending logs to %s --> %v", this.address, err)
+						}
 					}
 					break
 				case kite.A_SETUP:
+					// Setup outcome is reported to client by setupServer
 					if err := ks.setupServer(message, this); err != nil {
-						ks.address.Notify(kite.Event{Data: fmt.Sprintf("Error provisioning setup -> %s", err)}, this, message.Sender)
 						log.Printf("Error provisioning setup from %s -> %s", message.Sender, err)
 					} else {
-						ks.address.Notify(kite.Event{Data: "Server setup successfully provisioned"}, this, message.Sender)
 						log.Printf("Server setup successfully provisioned from %s", message.Sender)
 					}
 					break
 				case kite.A_ACTIVATE:
-					if err := ks.activateAddress(message.Data.(string)); err == nil {
+					if err := ks.activateAddress(payloadText(message.Data), "ws:"+this.auth); err == nil {
 						log.Printf("New address activated")
+					} else {
+						log.Printf("Activation from %s failed --> %v", this.address, err)
+						ks.replyError(this, message, ErrorReply{Code: E_ACTIVATION_FAILED, Message: err.Error()})
+					}
+					break
+				case A_ACK:
+					ks.acknowledge(payloadText(message.Data), this)
+					break
+				case A_PRESENCE:
+					if !ks.requireFeature(message, this, F_PRESENCE) || !ks.checkAcl(message, this, presencePattern(message.Data)) {
+						break
+					}
+					presences := ks.whoIsOnline(presencePattern(message.Data))
+					reply := Envelope{Message: kite.Message{Action: A_PRESENCE, Sender: ks.config().Address, Receiver: this.address, Data: presences}, CorrelationId: message.CorrelationId}
+					if err := this.write(reply); err != nil {
+						log.Printf("Error sending presence to %s --> %v", this.address, err)
+					}
+					break
+				case A_SUBSCRIBE:
+					if !ks.requireFeature(message, this, F_PRESENCE) || !ks.checkAcl(message, this, presencePattern(message.Data)) {
+						break
 					}
+					this.subscribe(presencePattern(message.Data))
+					break
+				case A_UNSUBSCRIBE:
+					if !ks.requireFeature(message, this, F_PRESENCE) {
+						break
+					}
+					this.unsubscribe(presencePattern(message.Data))
 					break
 				default:
-					if message.Receiver.Domain == "telegram" {
-						ks.sendToTelegram(message.Data.(string))
+					if ks.resolveRequest(message) {
+						log.Printf("%s reply %s routed from %s\n", message.Action, message.CorrelationId, message.Sender)
+					} else if !ks.checkAcl(message, this, message.Receiver) {
+						break
+					} else if message.Receiver.Domain == "telegram" {
+						ks.sendToTelegram(payloadText(message.Data))
 					} else {
-						ks.address.Notify(kite.Event{Data: message.Data.(string), Action: message.Action}, this, message.Receiver)
-						if ks.conf.Address.Match(message.Receiver) {
-							log.Printf("%s Action received -> %s from %s to %s\n", message.Action, message.Data.(string), message.Sender, message.Receiver)
+						env := Envelope{Message: kite.Message{Action: message.Action, Sender: this.address, Receiver: message.Receiver, Data: message.Data}, Id: newMessageId(), CorrelationId: message.CorrelationId}
+						if env.Action == kite.A_CMD {
+							ks.trackRequest(&env, this)
+						}
+						if reached := ks.route(env, this); len(reached) == 0 {
+							if ks.queueMessage(env) {
+								log.Printf("%s Action queued for offline %s from %s\n", message.Action, message.Receiver, message.Sender)
+								ks.reportDelivery(this, env.Id, env.Receiver, S_QUEUED)
+							} else {
+								ks.reportDelivery(this, env.Id, env.Receiver, S_FAILED)
+							}
+						}
+						if ks.config().Address.Match(message.Receiver) {
+							log.Printf("%s Action received -> %s from %s to %s\n", message.Action, payloadText(message.Data), message.Sender, message.Receiver)
 						}
 					}
 				}
@@ -110,7 +183,7 @@ func (ks *KiteServer) waitMessage(this *AddressObs) {
 
 		} else {
 			log.Printf("Error receiving message --> %v", err)
-			ks.address.Deregister(this)
+			ks.deregister(this)
 			this.conn.Close()
 			return
 		}
@@ -123,15 +196,23 @@ func (ks *KiteServer) wsHandler(w http.ResponseWriter, r *http.Request) {
 	ks.wg.Add(1)
 	defer ks.wg.Done()
 
+	if ks.shuttingDown() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Upgrader is configured for each connection, so configuration changes apply to new connections
+	upgrader := newUpgrader(ks.config().Websocket)
+
 	// Configuring check CORS (in production mode CORS should be on)
-	ks.upgrader.CheckOrigin = func(r *http.Request) bool {
+	upgrader.CheckOrigin = func(r *http.Request) bool {
 		re := regexp.MustCompile(`(?i)(?:(?:http|ws)[s]?://)([^/]*)`)
 		rHost := re.FindStringSubmatch(r.Header.Get("origin"))
 		if len(rHost) != 2 {
 			return false
 		}
-		if ks.conf.CheckOrigin {
-			if ks.conf.Server+":"+ks.conf.Port == rHost[1] {
+		if ks.config().CheckOrigin {
+			if ks.config().Server+":"+ks.config().Port == rHost[1] {
 				return true
 			} else {
 				return false
@@ -141,36 +222,73 @@ func (ks *KiteServer) wsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Refusing handshake before upgrade when none of kite protocol versions offered is served
+	if err := checkSubprotocols(websocket.Subprotocols(r)); err != nil {
+		log.Printf("Connection from %s refused --> %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Starting websocket connection
 	header := http.Header{}
-	conn, err := ks.upgrader.Upgrade(w, r, header)
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Printf("ERROR handle serveWs --> %v", err)
 		return
 	}
+	// Level is used only if compression was negotiated with client
+	_ = conn.SetCompressionLevel(ks.config().Websocket.compressionLevel())
 
 	// Adding new address
 	this, err := NewAddressObs(conn, ks)
 	if err != nil {
 		log.Printf("address creation error --> %v", err)
-		conn.WriteControl(websocket.CloseMessage, []byte(""),time.Now().Add(10*time.Second))
+		conn.WriteControl(websocket.CloseMessage, []byte(""), time.Now().Add(10*time.Second))
 		conn.Close()
 		return
 	}
 
 	conn.SetCloseHandler(func(code int, text string) error {
-		ks.address.Deregister(this)
+		ks.deregister(this)
 		return nil
 	})
-
-	ks.address.Register(this)
+	// Address must answer pings, read deadline is extended by each pong or message received
+	_ = conn.SetReadDeadline(ks.config().Websocket.readDeadline())
+	conn.SetPongHandler(func(string) error {
+		ks.seen(this)
+		return conn.SetReadDeadline(ks.config().Websocket.readDeadline())
+	})
 
 	// If client is of type Iot we provisioning configuration of it
 	if this.address.Type == kite.H_IOT {
 		ks.iotProvisioning(this)
 	}
 
-	// Sending a keep alive ping every minute
+	// Write lock is held from registration until queued messages are delivered, messages routed to address
+	// meanwhile are written after them
+	this.sync.Lock()
+	if err := ks.register(this); err != nil {
+		this.sync.Unlock()
+		this.reject(ks, ErrorReply{Code: E_DUPLICATE_SESSION, Message: err.Error()})
+		this.cancel()
+		return
+	}
+
+	// Connection accepted while server started shutting down
+	if ks.shuttingDown() {
+		this.sync.Unlock()
+		this.OnClose(kite.Event{Data: "Server is shutting down"})
+		ks.deregister(this)
+		this.cancel()
+		_ = conn.Close()
+		return
+	}
+
+	// Delivering messages received while address was offline
+	ks.deliverQueued(this)
+	this.sync.Unlock()
+
+	// Sending keep alive pings until connection ends
 	ks.wg.Add(1)
 	go ks.sendPing(this)
 	// Waiting message/request
@@ -179,61 +297,132 @@ func (ks *KiteServer) wsHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (ks *KiteServer) startServer() {
+// listen function open server listener (normally TLS in production mode)
+func (ks *KiteServer) listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", ks.config().Server, ks.config().Port))
+	if err != nil {
+		return nil, err
+	}
+	if !ks.config().Ssl {
+		return listener, nil
+	}
 
-	defer ks.wg.Done()
+	tlsConfig, err := ks.tlsConfig()
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(ks.config().Cert.SslCert, ks.config().Cert.SslKey); err == nil {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+			return tls.NewListener(listener, tlsConfig), nil
+		}
+	}
+	_ = listener.Close()
+	return nil, fmt.Errorf("configuring TLS --> %v", err)
+}
 
-	// Configuring websocket upgrader and handler function
-	ks.srv = http.Server{Addr: fmt.Sprintf("%s:%s", ks.conf.Server, ks.conf.Port), Handler: ks.mux}
+// startServer function serve http requests in background until server is shut down
+func (ks *KiteServer) startServer(listener net.Listener) {
 
-	ks.upgrader = websocket.Upgrader{ReadBufferSize: 2048, WriteBufferSize: 2048, CheckOrigin: func(r *http.Request) bool { return false }}
+	ks.srv = &http.Server{Addr: listener.Addr().String(), Handler: ks}
 
-	// Starting server (normally https in production mode)
-	if ks.conf.Ssl {
-		if err := ks.srv.ListenAndServeTLS(ks.conf.Cert.SslCert, ks.conf.Cert.SslKey); err != nil {
-			log.Printf("Ending listening server -> %v", err)
-		}
-	} else {
-		if err := ks.srv.ListenAndServe(); err != nil {
+	ks.wg.Add(1)
+	go func(srv *http.Server) {
+		defer ks.wg.Done()
+		if err := srv.Serve(listener); err != nil {
 			log.Printf("Ending listening server -> %v", err)
 		}
-	}
+	}(ks.srv)
 }
 
-func main() {
+// newKiteServer function create server instance and configure http handlers
+func newKiteServer(conf ServerConf) *KiteServer {
 	ks := new(KiteServer)
 
 	ks.address = kite.EventNotifier{
 		Observers: map[kite.Observer]struct{}{},
 	}
+	ks.setConfig(conf)
+	ks.deliveries.pending = map[string]*pendingDelivery{}
+	ks.requests.pending = map[string]*pendingRequest{}
+	ks.attempts.failures = map[string]*attempt{}
+	ks.presences.online = map[string]*onlinePresence{}
+	ks.heartbeats.started = time.Now()
+	ks.heartbeats.states = map[string]*heartbeatState{}
+	ks.heartbeats.notify = ks.sendToTelegram
+	ks.stopping = make(chan struct{})
+	ks.stopped = make(chan struct{})
+
+	ks.routes()
+	ks.ctx = context.Background()
 
-	// Loading configuration from configuration file
-	configFile := ""
-	conf := loadConfig(configFile)
-	ks.conf = *conf
+	return ks
+}
 
-	// Initializing http server
-	ks.mux = http.NewServeMux()
+// routes function initialize http handlers (Telegram webhook is added when configured)
+func (ks *KiteServer) routes() {
+	mux := http.NewServeMux()
 
-	ks.mux.HandleFunc("/ws", ks.wsHandler)
-	ks.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/ws", ks.wsHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "<h1>kite server is running...</h1>")
 	})
 
-	ks.ctx = context.Background()
+	ks.handlers.Lock()
+	defer ks.handlers.Unlock()
+	ks.mux = mux
+}
+
+// ServeHTTP function dispatch request to current handlers, handlers are replaced when configuration is reloaded
+func (ks *KiteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ks.handlers.RLock()
+	mux := ks.mux
+	ks.handlers.RUnlock()
+	mux.ServeHTTP(w, r)
+}
+
+func main() {
+	// Only validating configuration files, used before deploying a new configuration
+	if len(os.Args) >= 2 && os.Args[1] == checkConfigMode {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
+
+	// Loading configuration from configuration file, overridden by environment and command line
+	configFile, overrides, err := parseCommandLine(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid command line --> %v", err)
+	}
+	commandLine = overrides
+	configFile = configFileName(configFile)
+	conf := loadConfig(configFile)
+	if conf == nil {
+		log.Fatalf("Invalid configuration file %s", configFile)
+	}
+	ks := newKiteServer(*conf)
+	ks.configFile = configFile
+	ks.configureLog()
+	log.Printf("%s", conf)
 
-	if !ks.conf.SetupMode {
+	if !ks.config().SetupMode {
 		ks.configureTelegram()
-		ks.connectDatabase()
+		if err := ks.connectDatabase(); err != nil {
+			log.Fatalf("Error connecting database --> %v", err)
+		}
 	}
+	go ks.watchActivations()
+	go ks.watchSignals()
+	go ks.watchHeartbeats()
 
 	// Starting to listen and waiting connection
-	ks.wg.Add(1)
-	go ks.startServer()
+	listener, err := ks.listen()
+	if err != nil {
+		log.Fatalf("Error starting server --> %v", err)
+	}
+	ks.startServer(listener)
 
 	// Waiting end condition
-	log.Printf("kite server %s listening on port %s\n", conf.Server, conf.Port)
-	ks.sendToTelegram(fmt.Sprintf("Server %s is listening on port %s...", ks.conf.Address, ks.conf.Port))
-	ks.wg.Wait()
-	ks.sendToTelegram(fmt.Sprintf("Server %s is stopped...", ks.conf.Address))
+	log.Printf("kite server %s listening on port %s\n", ks.config().Server, ks.config().Port)
+	ks.sendToTelegram(fmt.Sprintf("Server %s is listening on port %s...", ks.config().Address, ks.config().Port))
+	<-ks.stopped
+	if ks.failed {
+		os.Exit(1)
+	}
 }
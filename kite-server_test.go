@@ -0,0 +1,727 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	testAdminAddress   = "test.cli.admin.console.1"
+	testAdminKey       = "admin-api-key-0001"
+	testBrowserAddress = "test.browser.web.page.1"
+	testBrowserKey     = "browser-api-key-0001"
+	testIotAddress     = "test.iot.sensor.board.1"
+	testIotKey         = "iot-api-key-0001"
+)
+
+type testClient struct {
+	conn    *websocket.Conn
+	address kite.Address
+}
+
+// testLog collect server log while sessions keep writing it
+type testLog struct {
+	sync    sync.Mutex
+	content strings.Builder
+}
+
+func (l *testLog) Write(p []byte) (int, error) {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	return l.content.Write(p)
+}
+
+func (l *testLog) String() string {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	return l.content.String()
+}
+
+// captureLog function redirect server log until end of test
+func captureLog(t *testing.T) *testLog {
+	l := &testLog{}
+	log.SetOutput(l)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return l
+}
+
+// newTestServer function start a kite server on httptest listener backed by in memory store
+func newTestServer(t *testing.T, configure ...func(conf *ServerConf)) (*KiteServer, *httptest.Server) {
+	t.Helper()
+
+	conf := ServerConf{
+		Address:        kite.Address{Domain: "test", Type: kite.H_SERVER, Host: "kite", Address: "*", Id: "*"},
+		DatabaseDriver: D_MEMORY,
+	}
+	for _, c := range configure {
+		c(&conf)
+	}
+	ks := newKiteServer(conf)
+	if err := ks.connectDatabase(); err != nil {
+		t.Fatalf("connecting in memory store --> %v", err)
+	}
+
+	for _, auth := range []kite.AddressAuth{
+		{Name: "test.cli.admin.*.*", ApiKey: testAdminKey, Enabled: true},
+		{Name: "test.browser.web.*.*", ApiKey: testBrowserKey, Enabled: true},
+		{Name: "test.iot.sensor.*.*", ApiKey: testIotKey, Enabled: true},
+	} {
+		if err := ks.db.UpsertAddressAuth(AddressAuth{AddressAuth: auth}); err != nil {
+			t.Fatalf("seeding address auth %s --> %v", auth.Name, err)
+		}
+	}
+
+	srv := httptest.NewServer(ks.mux)
+	t.Cleanup(func() {
+		srv.Close()
+		_ = ks.db.Close()
+	})
+	return ks, srv
+}
+
+// open function open websocket connection to test server
+func open(t *testing.T, srv *httptest.Server, address string) *testClient {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("dialing %s --> %v", url, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	c := &testClient{conn: conn}
+	c.address.StringToAddress(address)
+	return c
+}
+
+// testCapabilities are capabilities advertised by test clients, messages stay encoded in JSON
+var testCapabilities = []string{F_DELIVERY, F_CORRELATION, F_PRESENCE, F_ERRORS}
+
+// dial function open websocket and register with latest protocol version, returning first server answer
+func dial(t *testing.T, srv *httptest.Server, address string, apiKey string) (*testClient, Envelope, error) {
+	t.Helper()
+	return register(t, srv, address, Registration{ApiKey: apiKey, Version: maxProtocolVersion, Capabilities: testCapabilities})
+}
+
+// register function open websocket and send register message with data, returning first server answer
+func register(t *testing.T, srv *httptest.Server, address string, data interface{}) (*testClient, Envelope, error) {
+	t.Helper()
+
+	c := open(t, srv, address)
+	c.send(t, kite.A_REGISTER, kite.Address{}, data)
+
+	msg, err := c.receive()
+	return c, msg, err
+}
+
+// connect function dial server and wait until address is accepted and registered
+func connect(t *testing.T, ks *KiteServer, srv *httptest.Server, address string, apiKey string) *testClient {
+	t.Helper()
+	c, msg, err := dial(t, srv, address, apiKey)
+	return accepted(t, ks, c, msg, err)
+}
+
+// connectLegacy function connect address with legacy protocol (api key only registration)
+func connectLegacy(t *testing.T, ks *KiteServer, srv *httptest.Server, address string, apiKey string) *testClient {
+	t.Helper()
+	c, msg, err := register(t, srv, address, apiKey)
+	return accepted(t, ks, c, msg, err)
+}
+
+// accepted function check registration answer and wait until address is registered
+func accepted(t *testing.T, ks *KiteServer, c *testClient, msg Envelope, err error) *testClient {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("registering %s --> %v", c.address, err)
+	}
+	if msg.Action != kite.A_ACCEPTED {
+		t.Fatalf("registering %s --> got %s action, want %s", c.address, msg.Action, kite.A_ACCEPTED)
+	}
+	waitFor(t, "registration of "+c.address.String(), func() bool { return registered(ks, c.address) })
+	return c
+}
+
+func (c *testClient) send(t *testing.T, action kite.Action, receiver kite.Address, data interface{}) {
+	t.Helper()
+	if err := c.conn.WriteJSON(kite.Message{Action: action, Sender: c.address, Receiver: receiver, Data: data}); err != nil {
+		t.Fatalf("sending %s from %s --> %v", action, c.address, err)
+	}
+}
+
+func (c *testClient) receive() (Envelope, error) {
+	msg := Envelope{}
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := c.conn.ReadJSON(&msg)
+	return msg, err
+}
+
+// expect function read next message and check its action
+func (c *testClient) expect(t *testing.T, action kite.Action) Envelope {
+	t.Helper()
+	msg, err := c.receive()
+	if err != nil {
+		t.Fatalf("%s waiting %s --> %v", c.address, action, err)
+	}
+	if msg.Action != action {
+		t.Fatalf("%s got %s action, want %s (data %v)", c.address, msg.Action, action, msg.Data)
+	}
+	return msg
+}
+
+// errorCode function return code of error message
+func errorCode(msg Envelope) ErrorCode {
+	data, _ := msg.Data.(map[string]interface{})
+	code, _ := data["Code"].(string)
+	return ErrorCode(code)
+}
+
+func registered(ks *KiteServer, address kite.Address) bool {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+	for o := range ks.address.Observers {
+		if o.(*AddressObs).address == address {
+			return true
+		}
+	}
+	return false
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func address(str string) kite.Address {
+	a := kite.Address{}
+	a.StringToAddress(str)
+	return a
+}
+
+func TestRegisterAccepted(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	_, msg, err := dial(t, srv, testAdminAddress, testAdminKey)
+	if err != nil {
+		t.Fatalf("registering --> %v", err)
+	}
+	if msg.Action != kite.A_ACCEPTED {
+		t.Fatalf("got %s action, want %s", msg.Action, kite.A_ACCEPTED)
+	}
+	if data, _ := msg.Data.(map[string]interface{}); data["Message"] != "welcome "+testAdminAddress {
+		t.Errorf("unexpected welcome message %v", msg.Data)
+	}
+}
+
+func TestRegisterRejected(t *testing.T) {
+	_, srv := newTestServer(t)
+
+	// Wrong api key
+	c, msg, err := dial(t, srv, testAdminAddress, "wrong-api-key-0001")
+	if err != nil {
+		t.Fatalf("registering --> %v", err)
+	}
+	if msg.Action != A_ERROR || errorCode(msg) != E_UNAUTHORIZED {
+		t.Fatalf("got %s action (%v), want %s %s", msg.Action, msg.Data, A_ERROR, E_UNAUTHORIZED)
+	}
+	if _, err := c.receive(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+
+	// First message must be a registration, client capabilities are unknown so error is sent in legacy form
+	c = open(t, srv, testAdminAddress)
+	c.send(t, kite.A_NOTIFY, kite.Address{}, "hello")
+	if data, _ := c.expect(t, kite.A_REJECTED).Data.(map[string]interface{}); data["Message"] != "invalid action, must be register" {
+		t.Errorf("got rejected data %v", data)
+	}
+	if _, err := c.receive(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expected policy violation close, got %v", err)
+	}
+}
+
+func TestActivate(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+	output := captureLog(t)
+
+	// Unknown address with an api key is recorded as pending and connection refused
+	if _, msg, err := dial(t, srv, "test.cli.newcomer.console.1", "newcomer-api-key-0001"); err != nil || errorCode(msg) != E_ACTIVATION_REQUIRED {
+		t.Fatalf("unknown address got %s %v (%v), want %s", msg.Action, msg.Data, err, E_ACTIVATION_REQUIRED)
+	}
+
+	// Activation code is sent to Telegram only, without Telegram it is written to server log
+	_ = admin.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if msg := (Envelope{}); admin.conn.ReadJSON(&msg) == nil {
+		t.Errorf("activation code should not be broadcast, admin got %v", msg)
+	}
+	pending, err := ks.findAddressAuth("test.cli.newcomer.console.1")
+	if err != nil || pending.Enabled {
+		t.Fatalf("pending registration %+v --> %v", pending, err)
+	}
+	content := output.String()
+	idx := strings.Index(content, "activation code ")
+	if idx < 0 || len(content) < idx+len("activation code ")+6 {
+		t.Fatalf("activation code not logged, got %q", content)
+	}
+	activationCode := content[idx+len("activation code ") : idx+len("activation code ")+6]
+
+	admin.send(t, kite.A_ACTIVATE, ks.config().Address, activationCode)
+	waitFor(t, "address activation", func() bool {
+		auth, err := ks.findAddressAuth("test.cli.newcomer.console.1")
+		return err == nil && auth.Enabled
+	})
+
+	connect(t, ks, srv, "test.cli.newcomer.console.1", "newcomer-api-key-0001")
+}
+
+// TestPendingAddressName check pending authorization is named so that lookup of registered address finds it
+func TestPendingAddressName(t *testing.T) {
+	ks, srv := newTestServer(t)
+
+	for _, tc := range []struct{ address, name string }{
+		{"test.cli.newcomer.console.7", "test.cli.newcomer.console.*"},
+		{"test.endpoint.relay.board.2", "test.endpoint.relay.*.*"},
+	} {
+		if _, msg, err := dial(t, srv, tc.address, "newcomer-api-key-0001"); err != nil || errorCode(msg) != E_ACTIVATION_REQUIRED {
+			t.Fatalf("%s got %s %v (%v), want %s", tc.address, msg.Action, msg.Data, err, E_ACTIVATION_REQUIRED)
+		}
+		if pending, err := ks.findAddressAuth(tc.address); err != nil || pending.Name != tc.name {
+			t.Errorf("pending authorization of %s = %q --> %v, want %q", tc.address, pending.Name, err, tc.name)
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	ks, srv := newTestServer(t)
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	browser.send(t, kite.A_NOTIFY, address("test.iot.sensor.*.*"), "switch on")
+
+	msg := iot.expect(t, kite.A_NOTIFY)
+	if msg.Data != "switch on" {
+		t.Errorf("got %v data, want switch on", msg.Data)
+	}
+	if msg.Sender != browser.address {
+		t.Errorf("got %s sender, want %s", msg.Sender, browser.address)
+	}
+}
+
+func TestStalledReceiver(t *testing.T) {
+	ks, srv := newTestServer(t)
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	// Write to iot is stalled while message is routed to it
+	stalled := observer(ks, iot.address)
+	stalled.sync.Lock()
+	browser.send(t, kite.A_NOTIFY, iot.address, "stalled")
+	time.Sleep(100 * time.Millisecond)
+
+	// Registrations go on meanwhile
+	connect(t, ks, srv, testAdminAddress, testAdminKey)
+	stalled.sync.Unlock()
+	if msg := iot.expect(t, kite.A_NOTIFY); msg.Data != "stalled" {
+		t.Errorf("got %v data, want stalled", msg.Data)
+	}
+}
+
+func TestLog(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	admin.send(t, kite.A_LOG, ks.config().Address, "temperature is 21.5")
+	admin.send(t, kite.A_READLOG, ks.config().Address, "temperature")
+
+	msg := admin.expect(t, kite.A_LOG)
+	logs, _ := msg.Data.([]interface{})
+	if len(logs) != 1 {
+		t.Fatalf("got %d log messages, want 1", len(logs))
+	}
+	if entry := logs[0].(map[string]interface{}); entry["message"] != "temperature is 21.5" || entry["address"] != testAdminAddress {
+		t.Errorf("unexpected log message %v", entry)
+	}
+}
+
+func TestProvision(t *testing.T) {
+	ks, srv := newTestServer(t)
+	if err := ks.db.UpsertEndpoint(kite.Endpoint{Name: "test.endpoint.sensor.relay.1", Description: "relay"}); err != nil {
+		t.Fatalf("seeding endpoint --> %v", err)
+	}
+	if err := ks.db.UpsertEndpoint(kite.Endpoint{Name: "test.endpoint.other.relay.1", Description: "other"}); err != nil {
+		t.Fatalf("seeding endpoint --> %v", err)
+	}
+
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	msg := iot.expect(t, kite.A_PROVISION)
+	endpoints, _ := msg.Data.([]interface{})
+	if len(endpoints) != 1 {
+		t.Fatalf("got %d endpoints, want 1", len(endpoints))
+	}
+	if endpoint := (kite.Endpoint{}).SetFromInterface(endpoints[0]); endpoint.Name != "test.endpoint.sensor.relay.1" {
+		t.Errorf("unexpected endpoint %v", endpoint)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Outbox = ConfOutbox{Ttl: 60, Size: 2}
+	})
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	// Sensor is offline, only last two messages are kept
+	for _, data := range []string{"first", "second", "third"} {
+		browser.send(t, kite.A_NOTIFY, address(testIotAddress), data)
+	}
+	waitFor(t, "queued messages", func() bool {
+		store := ks.db.(*MemoryStore)
+		store.sync.RLock()
+		defer store.sync.RUnlock()
+		return len(store.outbox) == 2
+	})
+
+	// Messages which can't be written stay in outbox
+	other := connect(t, ks, srv, "test.iot.sensor.board.2", testIotKey)
+	closed := observer(ks, other.address).conn
+	_ = closed.Close()
+	ks.deliverQueued(&AddressObs{address: address(testIotAddress), conn: closed, writeTimeout: time.Second})
+	if queued, _ := ks.db.QueuedMessages(address(testIotAddress)); len(queued) != 2 {
+		t.Errorf("got %d queued messages after failed delivery, want 2", len(queued))
+	}
+
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	for _, data := range []string{"second", "third"} {
+		if msg := iot.expect(t, kite.A_NOTIFY); msg.Data != data || msg.Sender != browser.address {
+			t.Errorf("got %v from %s, want %s from %s", msg.Data, msg.Sender, data, browser.address)
+		}
+	}
+
+	waitFor(t, "delivered messages removed from outbox", func() bool {
+		queued, _ := ks.db.QueuedMessages(address(testIotAddress))
+		return len(queued) == 0
+	})
+
+	// Once connected messages are routed directly
+	browser.send(t, kite.A_NOTIFY, address(testIotAddress), "live")
+	if msg := iot.expect(t, kite.A_NOTIFY); msg.Data != "live" {
+		t.Errorf("got %v, want live", msg.Data)
+	}
+}
+
+// blockingStore hold outbox reads until released, so sessions read the same queued messages
+type blockingStore struct {
+	*MemoryStore
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) QueuedMessages(address kite.Address) ([]QueuedMessage, error) {
+	queued, err := s.MemoryStore.QueuedMessages(address)
+	s.read <- struct{}{}
+	<-s.release
+	return queued, err
+}
+
+// TestOutboxSessions check queued messages are delivered once, before live ones, to concurrent sessions of address
+func TestOutboxSessions(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Outbox = ConfOutbox{Ttl: 60, Size: 10}
+	})
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	queued := []string{"first", "second", "third"}
+	for _, data := range queued {
+		browser.send(t, kite.A_NOTIFY, address(testIotAddress), data)
+	}
+	waitFor(t, "queued messages", func() bool {
+		queued, _ := ks.db.QueuedMessages(address(testIotAddress))
+		return len(queued) == 3
+	})
+
+	// Both sessions read outbox before any of them delivers it, live message is sent meanwhile
+	store := &blockingStore{MemoryStore: ks.db.(*MemoryStore), read: make(chan struct{}, 2), release: make(chan struct{})}
+	ks.database.Lock()
+	ks.db = store
+	ks.database.Unlock()
+	sessions := []*testClient{connect(t, ks, srv, testIotAddress, testIotKey), connect(t, ks, srv, testIotAddress, testIotKey)}
+	<-store.read
+	<-store.read
+	browser.send(t, kite.A_NOTIFY, address(testIotAddress), "live")
+	time.Sleep(100 * time.Millisecond)
+	close(store.release)
+
+	delivered := map[string]int{}
+	for idx, c := range sessions {
+		var received []string
+		for {
+			msg := Envelope{}
+			_ = c.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			if err := c.conn.ReadJSON(&msg); err != nil {
+				break
+			}
+			if msg.Action == kite.A_NOTIFY {
+				received = append(received, msg.Data.(string))
+				delivered[msg.Data.(string)]++
+			}
+		}
+		if len(received) == 0 || received[len(received)-1] != "live" {
+			t.Errorf("session %d got %v, want queued messages before live one", idx, received)
+		}
+	}
+	for _, data := range queued {
+		if delivered[data] != 1 {
+			t.Errorf("queued message %s delivered %d time(s), want once", data, delivered[data])
+		}
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Delivery = ConfDelivery{Retries: 1, Timeout: 1}
+	})
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	report := func(status string) DeliveryReport {
+		t.Helper()
+		msg := browser.expect(t, A_DELIVERY)
+		r := DeliveryReport{}
+		r.Id, _ = msg.Data.(map[string]interface{})["Id"].(string)
+		r.Status, _ = msg.Data.(map[string]interface{})["Status"].(string)
+		if r.Status != status {
+			t.Fatalf("got %s delivery status, want %s", r.Status, status)
+		}
+		return r
+	}
+
+	// Acknowledged message
+	browser.send(t, kite.A_CMD, address(testIotAddress), "read")
+	msg := iot.expect(t, kite.A_CMD)
+	if msg.Id == "" {
+		t.Fatal("routed message without id")
+	}
+	if r := report(S_PENDING); r.Id != msg.Id {
+		t.Errorf("got report for %s, want %s", r.Id, msg.Id)
+	}
+	iot.send(t, A_ACK, ks.config().Address, msg.Id)
+	report(S_DELIVERED)
+
+	// Message never acknowledged is resent then reported as failed
+	browser.send(t, kite.A_CMD, address(testIotAddress), "set")
+	first := iot.expect(t, kite.A_CMD)
+	report(S_PENDING)
+	if retry := iot.expect(t, kite.A_CMD); retry.Id != first.Id {
+		t.Errorf("got retry of %s, want %s", retry.Id, first.Id)
+	}
+	report(S_FAILED)
+}
+
+func TestDeliveryNegotiated(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Delivery = ConfDelivery{Retries: 1, Timeout: 1}
+		conf.Outbox = ConfOutbox{Size: 10}
+	})
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	status := func(want string) {
+		t.Helper()
+		msg := browser.expect(t, A_DELIVERY)
+		if got, _ := msg.Data.(map[string]interface{})["Status"].(string); got != want {
+			t.Fatalf("got %s delivery status, want %s", got, want)
+		}
+	}
+
+	// Message queued for offline receiver is tracked once delivered from outbox
+	browser.send(t, kite.A_CMD, address(testIotAddress), "read")
+	status(S_QUEUED)
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	msg := iot.expect(t, kite.A_CMD)
+	status(S_PENDING)
+	iot.send(t, A_ACK, ks.config().Address, msg.Id)
+	status(S_DELIVERED)
+
+	// Legacy receiver never acknowledges, its messages are neither tracked nor resent
+	legacy := connectLegacy(t, ks, srv, "test.iot.sensor.board.2", testIotKey)
+	legacy.expect(t, kite.A_PROVISION)
+	browser.send(t, kite.A_NOTIFY, legacy.address, "switch on")
+	legacy.expect(t, kite.A_NOTIFY)
+	_ = legacy.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := legacy.conn.ReadJSON(&msg); err == nil {
+		t.Errorf("legacy receiver got %s %v, want nothing", msg.Action, msg.Data)
+	}
+	_ = browser.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := browser.conn.ReadJSON(&msg); err == nil {
+		t.Errorf("sender got %s %v for legacy receiver, want nothing", msg.Action, msg.Data)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.CommandTimeout = 1
+	})
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	// Reply is routed back to originator only, whatever its receiver
+	browser.send(t, kite.A_CMD, address(testIotAddress), "read")
+	cmd := iot.expect(t, kite.A_CMD)
+	if cmd.CorrelationId == "" {
+		t.Fatal("command without correlation id")
+	}
+	reply := Envelope{Message: kite.Message{Action: kite.A_NOTIFY, Sender: iot.address, Receiver: address("*.*.*.*.*"), Data: "21.5"}, CorrelationId: cmd.CorrelationId}
+	if err := iot.conn.WriteJSON(reply); err != nil {
+		t.Fatalf("sending reply --> %v", err)
+	}
+	if msg := browser.expect(t, kite.A_NOTIFY); msg.Data != "21.5" || msg.CorrelationId != cmd.CorrelationId {
+		t.Errorf("got reply %v (%s), want 21.5 (%s)", msg.Data, msg.CorrelationId, cmd.CorrelationId)
+	}
+	_ = admin.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if msg := (Envelope{}); admin.conn.ReadJSON(&msg) == nil {
+		t.Errorf("reply should not be broadcast, admin got %v", msg)
+	}
+
+	// Command without reply
+	browser.send(t, kite.A_CMD, address(testIotAddress), "set")
+	cmd = iot.expect(t, kite.A_CMD)
+	if msg := browser.expect(t, A_ERROR); msg.CorrelationId != cmd.CorrelationId || errorCode(msg) != E_COMMAND_TIMEOUT {
+		t.Errorf("got %s error for %s, want %s for %s", errorCode(msg), msg.CorrelationId, E_COMMAND_TIMEOUT, cmd.CorrelationId)
+	}
+}
+
+// TestCommandSameCorrelationId check replies reach their own originator when clients choose the same correlation id
+func TestCommandSameCorrelationId(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.CommandTimeout = 1
+	})
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	commands := map[string]Envelope{}
+	for _, c := range []*testClient{browser, admin} {
+		if err := c.conn.WriteJSON(Envelope{Message: kite.Message{Action: kite.A_CMD, Sender: c.address, Receiver: address(testIotAddress), Data: c.address.Host}, CorrelationId: "req-1"}); err != nil {
+			t.Fatalf("sending command --> %v", err)
+		}
+		cmd := iot.expect(t, kite.A_CMD)
+		commands[cmd.Data.(string)] = cmd
+	}
+	if commands["web"].CorrelationId == commands["admin"].CorrelationId {
+		t.Fatalf("commands sent with same correlation id %s", commands["admin"].CorrelationId)
+	}
+
+	// Replies are sent in reverse order, each one goes back to its originator with its own correlation id
+	for _, host := range []string{"admin", "web"} {
+		reply := Envelope{Message: kite.Message{Action: kite.A_NOTIFY, Sender: iot.address, Receiver: address("*.*.*.*.*"), Data: host}, CorrelationId: commands[host].CorrelationId}
+		if err := iot.conn.WriteJSON(reply); err != nil {
+			t.Fatalf("sending reply --> %v", err)
+		}
+	}
+	for _, c := range []*testClient{browser, admin} {
+		if msg := c.expect(t, kite.A_NOTIFY); msg.Data != c.address.Host || msg.CorrelationId != "req-1" {
+			t.Errorf("%s got reply %v (%s), want %s (req-1)", c.address, msg.Data, msg.CorrelationId, c.address.Host)
+		}
+	}
+
+	// No pending command is left to time out
+	for _, c := range []*testClient{browser, admin} {
+		_ = c.conn.SetReadDeadline(time.Now().Add(1500 * time.Millisecond))
+		if msg := (Envelope{}); c.conn.ReadJSON(&msg) == nil {
+			t.Errorf("%s got %s %v after reply", c.address, msg.Action, msg.Data)
+		}
+	}
+}
+
+func TestHashedSecrets(t *testing.T) {
+	ks, srv := newTestServer(t)
+
+	// Plaintext records are hashed and still accepted
+	ks.migrateSecrets()
+	if auth, _ := ks.findAddressAuth(testAdminAddress); !isHashed(auth.ApiKey) {
+		t.Fatalf("api key not hashed after migration %s", auth.ApiKey)
+	}
+	connect(t, ks, srv, testAdminAddress, testAdminKey)
+	if _, msg, _ := dial(t, srv, testAdminAddress, "wrong-api-key-0001"); msg.Action != A_ERROR {
+		t.Errorf("got %s action with wrong api key, want %s", msg.Action, A_ERROR)
+	}
+
+	// New address secrets are never stored in plaintext
+	_, _, _ = dial(t, srv, "test.cli.newcomer.console.1", "newcomer-api-key-0001")
+	waitFor(t, "pending address", func() bool {
+		_, err := ks.findAddressAuth("test.cli.newcomer.console.1")
+		return err == nil
+	})
+	if auth, _ := ks.findAddressAuth("test.cli.newcomer.console.1"); !isHashed(auth.ApiKey) || !isHashed(auth.ActivationCode) {
+		t.Errorf("pending address secrets not hashed %v", auth)
+	}
+
+	// Setup api key can be configured as hash
+	hash, _ := hashSecret("setup-api-key")
+	if !checkSecret(hash, "setup-api-key") || checkSecret(hash, "other-api-key") || !checkSecret("plain", "plain") || checkSecret("", "") {
+		t.Error("checkSecret mismatch")
+	}
+}
+
+func TestAcl(t *testing.T) {
+	ks, srv := newTestServer(t)
+	_ = ks.db.UpsertAddressAuth(AddressAuth{
+		AddressAuth: kite.AddressAuth{Name: "test.browser.restricted.*.*", ApiKey: testBrowserKey, Enabled: true},
+		Acl:         []AclRule{{Receiver: "test.iot.sensor.*.*", Actions: []kite.Action{kite.A_NOTIFY, A_PRESENCE}}},
+	})
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, "test.browser.restricted.page.1", testBrowserKey)
+
+	// Allowed action and receiver
+	browser.send(t, kite.A_NOTIFY, address(testIotAddress), "allowed")
+	if msg := iot.expect(t, kite.A_NOTIFY); msg.Data != "allowed" {
+		t.Errorf("got %v, want allowed", msg.Data)
+	}
+
+	// Action not allowed, wildcard receiver not covered by rule
+	browser.send(t, kite.A_CMD, address(testIotAddress), "denied")
+	browser.expect(t, A_ERROR)
+	browser.send(t, kite.A_NOTIFY, address("*.*.*.*.*"), "denied")
+	browser.expect(t, A_ERROR)
+
+	// Sender claimed by client is replaced by registered address
+	_ = browser.conn.WriteJSON(kite.Message{Action: kite.A_NOTIFY, Sender: address(testAdminAddress), Receiver: address(testIotAddress), Data: "spoofed"})
+	if msg := iot.expect(t, kite.A_NOTIFY); msg.Sender != browser.address {
+		t.Errorf("got message from %s, want %s", msg.Sender, browser.address)
+	}
+
+	// Server actions are checked too, presence only of addresses covered by rule
+	browser.send(t, A_PRESENCE, ks.config().Address, "test.iot.sensor.*.*")
+	browser.expect(t, A_PRESENCE)
+	browser.send(t, A_PRESENCE, ks.config().Address, "")
+	browser.expect(t, A_ERROR)
+	browser.send(t, A_SUBSCRIBE, ks.config().Address, "test.iot.sensor.*.*")
+	browser.expect(t, A_ERROR)
+	browser.send(t, kite.A_READLOG, address(testIotAddress), "ACL")
+	browser.expect(t, A_ERROR)
+
+	if logs := ks.readLog("ACL violation"); len(logs) != 5 {
+		t.Errorf("got %d logged violations, want 5", len(logs))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// Envelope is a kite.Message extended with server routing information, extra fields are ignored by legacy clients
+	Envelope struct {
+		kite.Message  `bson:",inline"`
+		Id            string `bson:"id,omitempty" json:"Id,omitempty"`
+		CorrelationId string `bson:"correlation_id,omitempty" json:"CorrelationId,omitempty"`
+	}
+)
+
+const (
+	// Server actions definition (not yet part of kite-common)
+	A_ACK      kite.Action = "ack"
+	A_DELIVERY kite.Action = "delivery"
+)
+
+// newMessageId function return a new unique message identifier
+func newMessageId() string {
+	return primitive.NewObjectID().Hex()
+}
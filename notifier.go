@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+)
+
+// EventNotifier observers map is not safe for concurrent use, all accesses go through following functions
+
+// register function add observer to connected addresses and record its presence, sessions already connected with
+// same address are kicked or new one is rejected depending on session policy
+func (ks *KiteServer) register(o kite.Observer) error {
+	obs := o.(*AddressObs)
+	policy := ks.config().sessionPolicy()
+
+	ks.observers.Lock()
+	var kicked []*AddressObs
+	if duplicates := ks.sessions(obs.address); len(duplicates) > 0 {
+		switch policy {
+		case P_REJECT:
+			ks.observers.Unlock()
+			log.Printf("Session of %s from %s rejected --> address already connected", obs.address, obs.conn.RemoteAddr())
+			return fmt.Errorf("address %s already connected", obs.address)
+		case P_KICK:
+			for _, d := range duplicates {
+				ks.address.Deregister(d)
+			}
+			kicked = duplicates
+			break
+		default:
+			log.Printf("Session of %s from %s added to %d connected session(s)", obs.address, obs.conn.RemoteAddr(), len(duplicates))
+		}
+	}
+	ks.address.Register(o)
+	ks.observers.Unlock()
+
+	// New session is recorded first, address stays online while old sessions are kicked
+	ks.online(obs)
+	for _, d := range kicked {
+		ks.offline(d)
+		d.kick(obs)
+	}
+	return nil
+}
+
+// deregister function remove observer from connected addresses, presence is updated only once per observer
+func (ks *KiteServer) deregister(o kite.Observer) {
+	ks.observers.Lock()
+	_, registered := ks.address.Observers[o]
+	ks.address.Deregister(o)
+	ks.observers.Unlock()
+
+	if registered {
+		ks.offline(o.(*AddressObs))
+	}
+}
+
+// snapshot function return connected addresses, they are written once observers lock is released so a stalled
+// address doesn't block registrations
+func (ks *KiteServer) snapshot() []*AddressObs {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+
+	observers := make([]*AddressObs, 0, len(ks.address.Observers))
+	for o := range ks.address.Observers {
+		observers = append(observers, o.(*AddressObs))
+	}
+	return observers
+}
+
+// notify function send event to every connected address matching receiver
+func (ks *KiteServer) notify(e kite.Event, sender kite.Observer, receiver kite.Address) {
+	for _, o := range ks.snapshot() {
+		o.OnNotify(e, sender, receiver)
+	}
+}
+
+// closeAll function send close event to every connected address
+func (ks *KiteServer) closeAll(e kite.Event) {
+	for _, o := range ks.snapshot() {
+		o.OnClose(e)
+	}
+}
+
+// connected function check if at least one connected address match receiver
+func (ks *KiteServer) connected(receiver kite.Address) bool {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+	for o := range ks.address.Observers {
+		if o.(*AddressObs).address.Match(receiver) {
+			return true
+		}
+	}
+	return false
+}
+
+// session function return a connected observer registered with address, nil when address is offline
+func (ks *KiteServer) session(address kite.Address) *AddressObs {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+	if sessions := ks.sessions(address); len(sessions) > 0 {
+		return sessions[0]
+	}
+	return nil
+}
+
+// route function send envelope to every connected address matching its receiver and return these addresses
+func (ks *KiteServer) route(env Envelope, sender *AddressObs) []*AddressObs {
+	var reached []*AddressObs
+
+	for _, receiver := range ks.snapshot() {
+		if receiver.address.Match(env.Receiver) {
+			// Tracking before sending, acknowledgement can be received before write returns
+			ks.trackDelivery(env, sender, receiver)
+			if err := receiver.write(env); err != nil {
+				log.Printf("Error sending message %s to %s --> %v", env.Id, receiver.address, err)
+			}
+			reached = append(reached, receiver)
+		}
+	}
+	return reached
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"time"
+)
+
+type (
+	// QueuedMessage is a message held in outbox until its receiver is connected
+	QueuedMessage struct {
+		Id       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+		Time     time.Time          `bson:"time" json:"time"`
+		Receiver string             `bson:"receiver" json:"receiver"`
+		Message  Envelope           `bson:"message" json:"message"`
+	}
+
+	ConfOutbox struct {
+		Ttl  int `json:"ttl"`
+		Size int `json:"size"`
+	}
+)
+
+const (
+	// Outbox collection
+	C_OUTBOX kite.Collection = "outbox"
+)
+
+// queueMessage function hold message for offline receiver (outbox is enabled when its size is configured)
+func (ks *KiteServer) queueMessage(message Envelope) bool {
+	if ks.config().Outbox.Size <= 0 {
+		return false
+	}
+
+	ks.purgeOutbox()
+	queued := QueuedMessage{Time: time.Now(), Receiver: message.Receiver.String(), Message: message}
+	if err := ks.store().QueueMessage(queued, ks.config().Outbox.Size); err != nil {
+		log.Printf("Error queuing message for %s --> %v", message.Receiver, err)
+		return false
+	}
+	return true
+}
+
+// deliverQueued function send to newly connected address messages queued while it was offline, write lock of
+// address must be held so routed messages are received after queued ones
+func (ks *KiteServer) deliverQueued(this *AddressObs) {
+	if ks.config().Outbox.Size <= 0 {
+		return
+	}
+
+	ks.purgeOutbox()
+	queued, err := ks.store().QueuedMessages(this.address)
+	if err != nil {
+		log.Printf("Error reading outbox of %s --> %v", this.address, err)
+		return
+	}
+
+	// Messages are removed from outbox before being written, so each one is delivered to a single session of
+	// address, message failing to be written is queued again for next connection
+	delivered := 0
+	for _, q := range queued {
+		if err := ks.store().DeleteMessage(q.Id); err != nil {
+			if err != ErrNotFound {
+				log.Printf("Error removing queued message %s from outbox --> %v", q.Id.Hex(), err)
+			}
+			continue
+		}
+
+		// Sender is reported when still connected (but not on this session, its write lock is held),
+		// acknowledgement can be received before write returns
+		sender := ks.session(q.Message.Sender)
+		if sender == this {
+			sender = nil
+		}
+		ks.trackDelivery(q.Message, sender, this)
+		if err := this.send(q.Message); err != nil {
+			ks.cancelDelivery(q.Message.Id, this)
+			if err := ks.store().QueueMessage(q, ks.config().Outbox.Size); err != nil {
+				log.Printf("Error queuing again message %s for %s --> %v", q.Id.Hex(), this.address, err)
+			}
+			log.Printf("Error delivering queued message to %s, %d message(s) kept in outbox --> %v", this.address, len(queued)-delivered, err)
+			break
+		}
+		delivered++
+	}
+	if delivered > 0 {
+		log.Printf("%d queued message(s) delivered to %s", delivered, this.address)
+	}
+}
+
+// purgeOutbox function remove expired messages from outbox (ttl 0 means messages never expire)
+func (ks *KiteServer) purgeOutbox() {
+	if ks.config().Outbox.Ttl <= 0 {
+		return
+	}
+	if err := ks.store().PurgeMessages(time.Now().Add(-time.Duration(ks.config().Outbox.Ttl) * time.Second)); err != nil {
+		log.Printf("Error purging outbox --> %v", err)
+	}
+}
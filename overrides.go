@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type (
+	// confField is a configuration value named after its json path, "cert.ssl_key" is named cert_ssl_key
+	confField struct {
+		name   string
+		value  reflect.Value
+		secret bool
+	}
+
+	// flagOverride is a command line flag stored as configuration override
+	flagOverride struct {
+		name      string
+		boolean   bool
+		overrides map[string]string
+	}
+)
+
+const (
+	envPrefix  = "KITE_"
+	fileSuffix = "_file"
+	maskedConf = "********"
+)
+
+// commandLine hold configuration overrides given as flags, applied each time configuration is loaded
+var commandLine = map[string]string{}
+
+// confFields function list configuration values of struct, nested structures are flattened
+func confFields(v reflect.Value, prefix string) []confField {
+	var fields []confField
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		name = prefix + name
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(kite.Address{}) {
+			fields = append(fields, confFields(v.Field(i), name+"_")...)
+			continue
+		}
+		fields = append(fields, confField{name: name, value: v.Field(i), secret: field.Tag.Get("conf") == "secret"})
+	}
+	return fields
+}
+
+// set function convert and store value in configuration field
+func (f confField) set(value string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(value)
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", f.name, value)
+		}
+		f.value.SetBool(b)
+	case int, int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid number %q", f.name, value)
+		}
+		f.value.SetInt(n)
+	case kite.Address:
+		address := kite.Address{}
+		address.StringToAddress(value)
+		f.value.Set(reflect.ValueOf(address))
+	default:
+		return fmt.Errorf("%s: can't be overridden", f.name)
+	}
+	return nil
+}
+
+// applyOverrides function override configuration with KITE_* environment variables then command line flags,
+// <name>_file variants read value from a file (secrets mounted in containers), plain value wins over file
+func (c *ServerConf) applyOverrides(lookupEnv func(string) (string, bool), flags map[string]string) error {
+	var problems ConfigError
+
+	for _, field := range confFields(reflect.ValueOf(c).Elem(), "") {
+		for _, source := range []func(string) (string, bool){
+			func(name string) (string, bool) { return lookupEnv(envPrefix + strings.ToUpper(name)) },
+			func(name string) (string, bool) { value, ok := flags[name]; return value, ok },
+		} {
+			if file, ok := source(field.name + fileSuffix); ok {
+				content, err := ioutil.ReadFile(file)
+				if err == nil {
+					err = field.set(strings.TrimRight(string(content), "\r\n"))
+				}
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", field.name+fileSuffix, err))
+				}
+			}
+			if value, ok := source(field.name); ok {
+				if err := field.set(value); err != nil {
+					problems = append(problems, err.Error())
+				}
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// parseCommandLine function parse command line arguments, configuration file can be given as first argument
+// or with -config flag, every configuration field can be given as flag (-database-password, -cert-ssl-key...)
+func parseCommandLine(args []string) (configFile string, overrides map[string]string, err error) {
+	overrides = make(map[string]string)
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		configFile = args[0]
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet("kite-server", flag.ContinueOnError)
+	flags.StringVar(&configFile, "config", configFile, "configuration file")
+	for _, field := range confFields(reflect.ValueOf(&ServerConf{}).Elem(), "") {
+		for _, name := range []string{field.name, field.name + fileSuffix} {
+			usage := fmt.Sprintf("override %s (environment %s)", name, envPrefix+strings.ToUpper(name))
+			boolean := name == field.name && field.value.Kind() == reflect.Bool
+			flags.Var(&flagOverride{name: name, boolean: boolean, overrides: overrides}, strings.ReplaceAll(name, "_", "-"), usage)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return "", nil, err
+	}
+	if flags.NArg() > 0 {
+		return "", nil, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	if configFile == "" {
+		configFile, _ = os.LookupEnv(envPrefix + "CONFIG")
+	}
+	return configFile, overrides, nil
+}
+
+func (f *flagOverride) String() string {
+	if f == nil || f.overrides == nil {
+		return ""
+	}
+	return f.overrides[f.name]
+}
+
+// IsBoolFlag function allow boolean flag without value (-ssl)
+func (f *flagOverride) IsBoolFlag() bool {
+	return f.boolean
+}
+
+func (f *flagOverride) Set(value string) error {
+	f.overrides[f.name] = value
+	return nil
+}
+
+// masked function return a copy of configuration with secrets hidden
+func (c ServerConf) masked() ServerConf {
+	for _, field := range confFields(reflect.ValueOf(&c).Elem(), "") {
+		if field.secret && field.value.String() != "" {
+			field.value.SetString(maskedConf)
+		}
+	}
+	return c
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	_ = ioutil.WriteFile(secret, []byte("from-file\n"), 0600)
+
+	configFile, flags, err := parseCommandLine([]string{"./config/test.json", "-port", "9000", "-ssl", "-cert-ssl-key", "flag.key", "-telegram-chat-id", "42"})
+	if err != nil {
+		t.Fatalf("parsing command line --> %v", err)
+	}
+	if configFile != "./config/test.json" {
+		t.Errorf("config file %s", configFile)
+	}
+
+	env := map[string]string{
+		"KITE_PORT":                   "8000",
+		"KITE_SERVER":                 "127.0.0.1",
+		"KITE_DATABASE_PASSWORD_FILE": secret,
+		"KITE_TELEGRAM_BOT_ID":        "bot-token",
+		"KITE_ADDRESS":                "test.server.kite.*.*",
+		"KITE_OUTBOX_SIZE":            "50",
+	}
+	lookupEnv := func(name string) (string, bool) { value, ok := env[name]; return value, ok }
+
+	c := &ServerConf{Port: "4433", Server: "0.0.0.0", ApiKey: "api-key"}
+	if err := c.applyOverrides(lookupEnv, flags); err != nil {
+		t.Fatalf("applying overrides --> %v", err)
+	}
+
+	// command line flags win over environment which win over file
+	if c.Port != "9000" || c.Server != "127.0.0.1" || !c.Ssl || c.Cert.SslKey != "flag.key" {
+		t.Errorf("precedence not respected --> port %s, server %s, ssl %v, key %s", c.Port, c.Server, c.Ssl, c.Cert.SslKey)
+	}
+	if c.DatabasePassword != "from-file" || c.Telegram.BotId != "bot-token" || c.Telegram.ChatId != 42 || c.Outbox.Size != 50 {
+		t.Errorf("overrides not applied --> %+v", c)
+	}
+	if c.Address.String() != "test.server.kite.*.*" {
+		t.Errorf("address override %s", c.Address)
+	}
+
+	printed := c.String()
+	for _, secret := range []string{"api-key", "from-file", "bot-token"} {
+		if strings.Contains(printed, secret) {
+			t.Errorf("secret %s printed --> %s", secret, printed)
+		}
+	}
+	if c.ApiKey != "api-key" {
+		t.Error("masking changed configuration")
+	}
+
+	env["KITE_DELIVERY_RETRIES"] = "many"
+	if err := c.applyOverrides(lookupEnv, nil); err == nil {
+		t.Error("invalid number accepted")
+	}
+}
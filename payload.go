@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+)
+
+type (
+	// PayloadError is returned when data of a message doesn't match schema of its action
+	PayloadError struct {
+		Action   kite.Action `json:"Action"`
+		Expected string      `json:"Expected"`
+		Got      string      `json:"Got"`
+	}
+
+	payloadSchema string
+)
+
+const (
+	// Payload schemas, message is a string or an object (routed actions without specific schema)
+	schemaString       payloadSchema = "string"
+	schemaRegistration payloadSchema = "api key or registration"
+	schemaMessage      payloadSchema = "string or object"
+	schemaPattern      payloadSchema = "address pattern"
+	schemaEndpoints    payloadSchema = "endpoint list"
+	schemaSetup        payloadSchema = "setup message"
+)
+
+// actionSchemas define payload expected for each action, other actions are validated against schemaMessage
+var actionSchemas = map[kite.Action]payloadSchema{
+	kite.A_REGISTER:  schemaRegistration,
+	kite.A_LOG:       schemaString,
+	kite.A_READLOG:   schemaString,
+	kite.A_ACTIVATE:  schemaString,
+	kite.A_CMD:       schemaString,
+	kite.A_SETUP:     schemaSetup,
+	kite.A_PROVISION: schemaEndpoints,
+	A_ACK:            schemaString,
+	A_PRESENCE:       schemaPattern,
+	A_SUBSCRIBE:      schemaPattern,
+	A_UNSUBSCRIBE:    schemaPattern,
+}
+
+func (e PayloadError) Error() string {
+	return fmt.Sprintf("invalid %s payload, %s expected, got %s", e.Action, e.Expected, e.Got)
+}
+
+// decodePayload function validate data against schema of action and return it decoded (string, object, registration,
+// endpoint list or setup message), data comes from clients and is never trusted
+func decodePayload(action kite.Action, data interface{}) (interface{}, error) {
+	schema, ok := actionSchemas[action]
+	if !ok {
+		schema = schemaMessage
+	}
+	if value, ok := schema.decode(data); ok {
+		return value, nil
+	}
+	return nil, PayloadError{Action: action, Expected: string(schema), Got: payloadType(data)}
+}
+
+func (s payloadSchema) decode(data interface{}) (interface{}, bool) {
+	switch s {
+	case schemaString:
+		value, ok := data.(string)
+		return value, ok
+	case schemaRegistration:
+		switch value := data.(type) {
+		case nil:
+			return Registration{}, true
+		case string:
+			return Registration{ApiKey: value}, true
+		case map[string]interface{}:
+			var registration Registration
+			if convertPayload(value, &registration) != nil {
+				return nil, false
+			}
+			return registration, true
+		}
+		return nil, false
+	case schemaMessage:
+		switch data.(type) {
+		case string, map[string]interface{}:
+			return data, true
+		}
+		return nil, false
+	case schemaPattern:
+		// Pattern is optional, every address is matched when empty
+		if data == nil {
+			return "", true
+		}
+		value, ok := data.(string)
+		return value, ok
+	case schemaEndpoints:
+		var endpoints []kite.Endpoint
+		if _, ok := data.([]interface{}); !ok || convertPayload(data, &endpoints) != nil {
+			return nil, false
+		}
+		return endpoints, true
+	case schemaSetup:
+		var setup kite.SetupMessage
+		if _, ok := data.(map[string]interface{}); !ok || convertPayload(data, &setup) != nil {
+			return nil, false
+		}
+		return setup, true
+	}
+	return nil, false
+}
+
+// convertPayload function decode generic json data (as read from websocket) to its typed value
+func convertPayload(data interface{}, value interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, value)
+}
+
+// payloadText function return payload as text, objects are json encoded
+func payloadText(data interface{}) string {
+	if text, ok := data.(string); ok {
+		return text
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprint(data)
+	}
+	return string(encoded)
+}
+
+// payloadType function return json type name of data
+func payloadType(data interface{}) string {
+	switch data.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64, json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", data)
+}
+
+// rejectPayload function reply to sender of a message which data doesn't match schema of its action
+func (ks *KiteServer) rejectPayload(message Envelope, this *AddressObs, err error) {
+	log.Printf("Invalid payload from %s --> %v", this.address, err)
+	ks.replyError(this, message, ErrorReply{Code: E_INVALID_PAYLOAD, Message: err.Error(), Details: err})
+}
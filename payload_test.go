@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestDecodePayload(t *testing.T) {
+	for _, tc := range []struct {
+		action kite.Action
+		data   interface{}
+		valid  bool
+	}{
+		{kite.A_LOG, "message", true},
+		{kite.A_LOG, 42.0, false},
+		{kite.A_LOG, map[string]interface{}{"message": "x"}, false},
+		{kite.A_SETUP, map[string]interface{}{"api_key": "key", "setup_files": []interface{}{}}, true},
+		{kite.A_SETUP, "key", false},
+		{kite.A_SETUP, map[string]interface{}{"setup_files": "file"}, false},
+		{kite.A_PROVISION, []interface{}{map[string]interface{}{"name": "sensor"}}, true},
+		{kite.A_PROVISION, map[string]interface{}{"name": "sensor"}, false},
+		{A_PRESENCE, nil, true},
+		{A_PRESENCE, true, false},
+		{kite.A_NOTIFY, map[string]interface{}{"temperature": 21.5}, true},
+		{kite.A_NOTIFY, []interface{}{"a"}, false},
+	} {
+		_, err := decodePayload(tc.action, tc.data)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s payload %v --> %v, want valid %v", tc.action, tc.data, err, tc.valid)
+		}
+	}
+}
+
+func TestInvalidPayload(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	// Malformed messages are rejected without closing connection
+	admin.send(t, kite.A_LOG, ks.config().Address, 42)
+	data, _ := admin.expect(t, A_ERROR).Data.(map[string]interface{})
+	details, _ := data["Details"].(map[string]interface{})
+	if data["Code"] != string(E_INVALID_PAYLOAD) || details["Action"] != string(kite.A_LOG) || details["Expected"] != "string" || details["Got"] != "number" {
+		t.Errorf("error data %v", data)
+	}
+	admin.send(t, kite.A_ACTIVATE, ks.config().Address, map[string]string{"code": "123456"})
+	admin.expect(t, A_ERROR)
+
+	admin.send(t, A_PRESENCE, ks.config().Address, testAdminAddress)
+	admin.expect(t, A_PRESENCE)
+
+	// Registration with invalid api key type, client capabilities are unknown so error is sent in legacy form
+	c := open(t, srv, testBrowserAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, 1234)
+	c.expect(t, kite.A_REJECTED)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Presence is the connection state of an address
+	Presence struct {
+		Address       string    `bson:"address" json:"address"`
+		Online        bool      `bson:"online" json:"online"`
+		LastConnected time.Time `bson:"last_connected" json:"last_connected"`
+		LastSeen      time.Time `bson:"last_seen" json:"last_seen"`
+	}
+
+	// Presences hold state of connected addresses, an address can have several connections
+	Presences struct {
+		sync   sync.Mutex
+		online map[string]*onlinePresence
+	}
+
+	onlinePresence struct {
+		presence    Presence
+		connections int
+		persisted   time.Time
+	}
+)
+
+const (
+	// Presence collection
+	C_PRESENCE kite.Collection = "presence"
+
+	// Presence actions, A_PRESENCE is a query when sent by client, an event or a query reply when sent by server
+	A_PRESENCE    kite.Action = "presence"
+	A_SUBSCRIBE   kite.Action = "subscribe"
+	A_UNSUBSCRIBE kite.Action = "unsubscribe"
+
+	// Last seen time is persisted at most once per interval while address is online
+	presencePersistInterval = time.Minute
+)
+
+// anyAddress match every address
+var anyAddress = kite.Address{Domain: "*", Type: "*", Host: "*", Address: "*", Id: "*"}
+
+// online function record new connection of address, online event is sent on first connection
+func (ks *KiteServer) online(o *AddressObs) {
+	if ks.config().SetupMode {
+		return
+	}
+	now := time.Now()
+	key := o.address.String()
+
+	ks.presences.sync.Lock()
+	p, ok := ks.presences.online[key]
+	if !ok {
+		p = &onlinePresence{presence: Presence{Address: key, Online: true, LastConnected: now, LastSeen: now}, persisted: now}
+		ks.presences.online[key] = p
+	}
+	p.connections++
+	presence := p.presence
+	ks.presences.sync.Unlock()
+
+	if !ok {
+		ks.savePresence(presence)
+		ks.announcePresence(presence)
+		ks.recovered(presence)
+	}
+}
+
+// offline function record end of connection of address, offline event is sent when last connection ends
+func (ks *KiteServer) offline(o *AddressObs) {
+	key := o.address.String()
+
+	ks.presences.sync.Lock()
+	p, ok := ks.presences.online[key]
+	if !ok {
+		ks.presences.sync.Unlock()
+		return
+	}
+	p.connections--
+	if p.connections > 0 {
+		ks.presences.sync.Unlock()
+		return
+	}
+	delete(ks.presences.online, key)
+	presence := p.presence
+	ks.presences.sync.Unlock()
+
+	presence.Online = false
+	presence.LastSeen = time.Now()
+	ks.savePresence(presence)
+	ks.announcePresence(presence)
+}
+
+// seen function update last seen time of address (message or pong received)
+func (ks *KiteServer) seen(o *AddressObs) {
+	now := time.Now()
+
+	ks.presences.sync.Lock()
+	p, ok := ks.presences.online[o.address.String()]
+	if !ok {
+		ks.presences.sync.Unlock()
+		return
+	}
+	p.presence.LastSeen = now
+	persist := now.Sub(p.persisted) >= presencePersistInterval
+	if persist {
+		p.persisted = now
+	}
+	presence := p.presence
+	ks.presences.sync.Unlock()
+
+	if persist {
+		ks.savePresence(presence)
+	}
+}
+
+// whoIsOnline function return known addresses matching pattern with their presence, connected addresses first
+func (ks *KiteServer) whoIsOnline(pattern kite.Address) []Presence {
+	presences := make(map[string]Presence)
+
+	if db := ks.store(); db != nil {
+		if stored, err := db.ListPresence(); err == nil {
+			for _, p := range stored {
+				presences[p.Address] = p
+			}
+		} else {
+			log.Printf("Error reading presence --> %v", err)
+		}
+	}
+	ks.presences.sync.Lock()
+	for key, p := range ks.presences.online {
+		presences[key] = p.presence
+	}
+	ks.presences.sync.Unlock()
+
+	result := make([]Presence, 0, len(presences))
+	for _, p := range presences {
+		if parseAddress(p.Address).Match(pattern) {
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Online != result[j].Online {
+			return result[i].Online
+		}
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// syncPresence function align stored presence with connected addresses (after a crash or a database change)
+func (ks *KiteServer) syncPresence() {
+	stored, err := ks.store().ListPresence()
+	if err != nil {
+		log.Printf("Error reading presence --> %v", err)
+		return
+	}
+
+	ks.presences.sync.Lock()
+	var presences []Presence
+	for _, p := range stored {
+		if _, ok := ks.presences.online[p.Address]; p.Online && !ok {
+			p.Online = false
+			presences = append(presences, p)
+		}
+	}
+	for _, p := range ks.presences.online {
+		presences = append(presences, p.presence)
+	}
+	ks.presences.sync.Unlock()
+
+	for _, p := range presences {
+		ks.savePresence(p)
+	}
+}
+
+func (ks *KiteServer) savePresence(presence Presence) {
+	db := ks.store()
+	if db == nil {
+		return
+	}
+	if err := db.UpsertPresence(presence); err != nil {
+		log.Printf("Error saving presence of %s --> %v", presence.Address, err)
+	}
+}
+
+// announcePresence function send presence event to addresses subscribed to it
+func (ks *KiteServer) announcePresence(presence Presence) {
+	changed := parseAddress(presence.Address)
+	event := Envelope{Message: kite.Message{Action: A_PRESENCE, Sender: ks.config().Address, Data: presence}}
+
+	for _, subscriber := range ks.snapshot() {
+		if subscriber.subscribed(changed) {
+			event.Receiver = subscriber.address
+			if err := subscriber.write(event); err != nil {
+				log.Printf("Error sending presence of %s to %s --> %v", presence.Address, subscriber.address, err)
+			}
+		}
+	}
+}
+
+// subscribe function add pattern of addresses which presence events are sent to address
+func (o *AddressObs) subscribe(pattern kite.Address) {
+	o.watch.Lock()
+	defer o.watch.Unlock()
+	for _, s := range o.subscriptions {
+		if s == pattern {
+			return
+		}
+	}
+	o.subscriptions = append(o.subscriptions, pattern)
+}
+
+// unsubscribe function remove pattern from subscriptions of address
+func (o *AddressObs) unsubscribe(pattern kite.Address) {
+	o.watch.Lock()
+	defer o.watch.Unlock()
+	for idx, s := range o.subscriptions {
+		if s == pattern {
+			o.subscriptions = append(o.subscriptions[:idx], o.subscriptions[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (o *AddressObs) subscribed(changed kite.Address) bool {
+	o.watch.Lock()
+	defer o.watch.Unlock()
+	for _, pattern := range o.subscriptions {
+		if changed.Match(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// presencePattern function return address pattern given in presence message, every address when empty
+func presencePattern(data interface{}) kite.Address {
+	if pattern, ok := data.(string); ok && pattern != "" {
+		return parseAddress(pattern)
+	}
+	return anyAddress
+}
+
+func parseAddress(str string) kite.Address {
+	a := kite.Address{}
+	a.StringToAddress(str)
+	return a
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestPresence(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+	admin.send(t, A_SUBSCRIBE, ks.config().Address, "test.iot.*.*.*")
+
+	// presence function read presence event or query reply
+	presence := func(msg Envelope) Presence {
+		data, _ := msg.Data.(map[string]interface{})
+		online, _ := data["online"].(bool)
+		address, _ := data["address"].(string)
+		return Presence{Address: address, Online: online}
+	}
+
+	// Browser isn't subscribed, only iot presence is announced
+	connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	if p := presence(admin.expect(t, A_PRESENCE)); p.Address != testIotAddress || !p.Online {
+		t.Errorf("got %+v, want %s online", p, testIotAddress)
+	}
+
+	admin.send(t, A_PRESENCE, ks.config().Address, "test.*.*.*.*")
+	reply := admin.expect(t, A_PRESENCE)
+	if list, _ := reply.Data.([]interface{}); len(list) != 3 {
+		t.Errorf("who is online got %v, want 3 addresses", reply.Data)
+	}
+
+	_ = iot.conn.Close()
+	if p := presence(admin.expect(t, A_PRESENCE)); p.Address != testIotAddress || p.Online {
+		t.Errorf("got %+v, want %s offline", p, testIotAddress)
+	}
+
+	// Last seen is kept once address is offline
+	presences := ks.whoIsOnline(address(testIotAddress))
+	if len(presences) != 1 || presences[0].Online || presences[0].LastSeen.Before(presences[0].LastConnected) {
+		t.Errorf("stored presence %+v", presences)
+	}
+
+	admin.send(t, A_UNSUBSCRIBE, ks.config().Address, "test.iot.*.*.*")
+	iot = connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	// Next message is query reply, not presence event
+	admin.send(t, A_PRESENCE, ks.config().Address, testIotAddress)
+	if list, ok := admin.expect(t, A_PRESENCE).Data.([]interface{}); !ok || len(list) != 1 {
+		t.Errorf("presence event received after unsubscribe --> %v", list)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Registration is data of register message, legacy clients send their api key only
+	Registration struct {
+		ApiKey       string   `json:"api_key"`
+		Version      int      `json:"version"`
+		Capabilities []string `json:"capabilities"`
+	}
+)
+
+const (
+	// Protocol versions served, version 1 is the legacy protocol (api key only registration)
+	minProtocolVersion = 1
+	maxProtocolVersion = 2
+
+	// Features are negotiated from protocol version 2, legacy clients get plain messages and rejected actions
+	featuresProtocolVersion = 2
+
+	// Websocket subprotocol name of a protocol version is prefix followed by version number (kite.v2)
+	subprotocolPrefix = "kite.v"
+
+	// Features supported by server, negotiated features are the ones advertised by client and server
+	F_DELIVERY    = "delivery"
+	F_CORRELATION = "correlation"
+	F_PRESENCE    = "presence"
+	F_ERRORS      = "errors"
+)
+
+var serverCapabilities = []string{F_DELIVERY, F_CORRELATION, F_PRESENCE, F_ERRORS, F_CBOR}
+
+// subprotocols function return websocket subprotocols served, preferred (latest) version first
+func subprotocols() []string {
+	var protocols []string
+	for version := maxProtocolVersion; version >= minProtocolVersion; version-- {
+		protocols = append(protocols, fmt.Sprintf("%s%d", subprotocolPrefix, version))
+	}
+	return protocols
+}
+
+// subprotocolVersion function return protocol version of a kite subprotocol
+func subprotocolVersion(protocol string) (int, bool) {
+	if !strings.HasPrefix(protocol, subprotocolPrefix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(protocol, subprotocolPrefix))
+	return version, err == nil
+}
+
+// checkSubprotocols function refuse handshake offering kite subprotocols only in versions not served,
+// other subprotocols are ignored
+func checkSubprotocols(offered []string) error {
+	var versions []string
+	for _, protocol := range offered {
+		if version, ok := subprotocolVersion(protocol); ok {
+			if supportedVersion(version) {
+				return nil
+			}
+			versions = append(versions, protocol)
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unsupported protocol %s, server supports %s", strings.Join(versions, ", "), strings.Join(subprotocols(), ", "))
+}
+
+// negotiate function return protocol version and features used with client, version given in registration takes
+// precedence over websocket subprotocol, legacy protocol is used when client doesn't give any (features advertised
+// are also returned with unsupported version error, so this error is sent in a form client understands)
+func negotiate(registration Registration, subprotocol string) (int, []string, error) {
+	version := registration.Version
+	if version == 0 {
+		if v, ok := subprotocolVersion(subprotocol); ok {
+			version = v
+		} else {
+			version = minProtocolVersion
+		}
+	}
+
+	features := []string{}
+	for _, capability := range serverCapabilities {
+		for _, c := range registration.Capabilities {
+			if c == capability {
+				features = append(features, capability)
+				break
+			}
+		}
+	}
+
+	if !supportedVersion(version) {
+		return 0, features, ErrorReply{
+			Code:    E_UNSUPPORTED_VERSION,
+			Message: fmt.Sprintf("unsupported protocol version %d, server supports versions %d to %d", version, minProtocolVersion, maxProtocolVersion),
+			Details: map[string]int{"MinVersion": minProtocolVersion, "MaxVersion": maxProtocolVersion},
+		}
+	}
+	if version < featuresProtocolVersion {
+		return version, []string{}, nil
+	}
+	return version, features, nil
+}
+
+func supportedVersion(version int) bool {
+	return version >= minProtocolVersion && version <= maxProtocolVersion
+}
+
+// supports function check if feature was negotiated with address
+func (o *AddressObs) supports(feature string) bool {
+	for _, f := range o.features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// requireFeature function check address negotiated feature used by message action, address is answered with an
+// error otherwise
+func (ks *KiteServer) requireFeature(message Envelope, this *AddressObs, feature string) bool {
+	if this.supports(feature) {
+		return true
+	}
+	ks.replyError(this, message, ErrorReply{
+		Code:    E_FEATURE_REQUIRED,
+		Message: fmt.Sprintf("%s action requires %s feature", message.Action, feature),
+		Details: map[string]string{"Feature": feature},
+	})
+	return false
+}
+
+// outgoing function return message as sent to address, message id is kept for delivery acknowledgements and
+// correlation, correlation id only when correlation is negotiated, legacy clients get plain kite messages
+func (o *AddressObs) outgoing(msg interface{}) interface{} {
+	env, ok := msg.(Envelope)
+	if !ok {
+		return msg
+	}
+	if o.version < featuresProtocolVersion {
+		return env.Message
+	}
+	if !o.supports(F_CORRELATION) {
+		env.CorrelationId = ""
+		if !o.supports(F_DELIVERY) {
+			env.Id = ""
+		}
+	}
+	return env
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiation(t *testing.T) {
+	_, srv := newTestServer(t)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	accepted := func(t *testing.T, msg Envelope) (float64, []interface{}) {
+		t.Helper()
+		if msg.Action != kite.A_ACCEPTED {
+			t.Fatalf("got %s action (%v), want %s", msg.Action, msg.Data, kite.A_ACCEPTED)
+		}
+		data, _ := msg.Data.(map[string]interface{})
+		version, _ := data["Version"].(float64)
+		features, _ := data["Features"].([]interface{})
+		return version, features
+	}
+
+	// Legacy registration with api key only
+	_, msg, _ := register(t, srv, testAdminAddress, testAdminKey)
+	if version, features := accepted(t, msg); version != 1 || len(features) != 0 {
+		t.Errorf("legacy registration got version %v features %v", version, features)
+	}
+
+	// Version and capabilities in register message, unknown capabilities are ignored
+	c := open(t, srv, testBrowserAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testBrowserKey, Version: 2, Capabilities: []string{F_PRESENCE, "teleport"}})
+	msg, _ = c.receive()
+	if version, features := accepted(t, msg); version != 2 || len(features) != 1 || features[0] != F_PRESENCE {
+		t.Errorf("registration got version %v features %v", version, features)
+	}
+
+	// Legacy version doesn't negotiate features
+	c = open(t, srv, testBrowserAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testBrowserKey, Version: 1, Capabilities: []string{F_PRESENCE}})
+	msg, _ = c.receive()
+	if version, features := accepted(t, msg); version != 1 || len(features) != 0 {
+		t.Errorf("legacy version registration got version %v features %v", version, features)
+	}
+
+	// Unsupported version error is sent in form advertised by client
+	c = open(t, srv, testBrowserAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testBrowserKey, Version: 9, Capabilities: []string{F_ERRORS}})
+	if code := errorCode(c.expect(t, A_ERROR)); code != E_UNSUPPORTED_VERSION {
+		t.Errorf("got %s error code, want %s", code, E_UNSUPPORTED_VERSION)
+	}
+	c = open(t, srv, testBrowserAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testBrowserKey, Version: 9})
+	c.expect(t, kite.A_REJECTED)
+
+	// Version given by websocket subprotocol
+	dialer := websocket.Dialer{Subprotocols: []string{"kite.v9", "kite.v2"}}
+	conn, _, err := dialer.Dial(url, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("dialing with subprotocol --> %v", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "kite.v2" {
+		t.Errorf("got subprotocol %q, want kite.v2", conn.Subprotocol())
+	}
+	c = &testClient{conn: conn, address: address(testIotAddress)}
+	c.send(t, kite.A_REGISTER, kite.Address{}, testIotKey)
+	msg, _ = c.receive()
+	if version, _ := accepted(t, msg); version != 2 {
+		t.Errorf("subprotocol registration got version %v", version)
+	}
+
+	dialer = websocket.Dialer{Subprotocols: []string{"kite.v9"}}
+	if _, resp, err := dialer.Dial(url, http.Header{"Origin": {srv.URL}}); err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsupported subprotocol got %v, want bad request", err)
+	}
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Delivery = ConfDelivery{Retries: 1, Timeout: 60}
+	})
+	legacy := connectLegacy(t, ks, srv, testBrowserAddress, testBrowserKey)
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+
+	// raw function read next message keeping its fields as sent
+	raw := func(c *testClient) map[string]interface{} {
+		t.Helper()
+		fields := make(map[string]interface{})
+		if err := c.conn.ReadJSON(&fields); err != nil {
+			t.Fatalf("%s reading --> %v", c.address, err)
+		}
+		return fields
+	}
+
+	// Legacy client gets rejected messages instead of errors, and presence isn't available
+	legacy.send(t, A_PRESENCE, ks.config().Address, testIotAddress)
+	if data, _ := legacy.expect(t, kite.A_REJECTED).Data.(map[string]interface{}); !strings.Contains(data["Message"].(string), "requires presence feature") {
+		t.Errorf("got rejected data %v", data)
+	}
+
+	// Legacy sender gets no delivery report, receiver negotiating delivery gets message id
+	legacy.send(t, kite.A_NOTIFY, iot.address, "switch on")
+	msg := iot.expect(t, kite.A_NOTIFY)
+	if msg.Id == "" {
+		t.Error("message without id sent to receiver negotiating delivery")
+	}
+	iot.send(t, A_ACK, ks.config().Address, msg.Id)
+
+	// Legacy receiver gets plain messages, without identifiers
+	_ = iot.conn.WriteJSON(Envelope{Message: kite.Message{Action: kite.A_NOTIFY, Sender: iot.address, Receiver: legacy.address, Data: "hello"}, CorrelationId: "c-1"})
+	fields := raw(legacy)
+	if fields["Action"] != string(kite.A_NOTIFY) {
+		t.Fatalf("legacy client got %v, want notify", fields)
+	}
+	if _, ok := fields["Id"]; ok {
+		t.Errorf("legacy client got message id %v", fields["Id"])
+	}
+	if _, ok := fields["CorrelationId"]; ok {
+		t.Errorf("legacy client got correlation id %v", fields["CorrelationId"])
+	}
+
+	// Client without correlation gets message id for acknowledgements only
+	c := open(t, srv, testAdminAddress)
+	c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testAdminKey, Version: 2, Capabilities: []string{F_DELIVERY}})
+	c.expect(t, kite.A_ACCEPTED)
+	waitFor(t, "registration of "+testAdminAddress, func() bool { return registered(ks, c.address) })
+	_ = iot.conn.WriteJSON(Envelope{Message: kite.Message{Action: kite.A_NOTIFY, Sender: iot.address, Receiver: c.address, Data: "hello"}, CorrelationId: "c-2"})
+	fields = raw(c)
+	if _, ok := fields["CorrelationId"]; ok || fields["Id"] == nil {
+		t.Errorf("client without correlation got %v", fields)
+	}
+}
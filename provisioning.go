@@ -9,9 +9,7 @@ import (
 func (ks *KiteServer) iotProvisioning(this *AddressObs) {
 	if endpoints, err := ks.findEndpoint(this.address); err == nil {
 		//log.Printf("%v", endpoints)
-		ks.sync.Lock()
-		defer ks.sync.Unlock()
-		if err := this.conn.WriteJSON(kite.Message{Sender: ks.conf.Address, Receiver: this.address, Action: kite.A_PROVISION, Data: endpoints}); err != nil {
+		if err := this.write(kite.Message{Sender: ks.config().Address, Receiver: this.address, Action: kite.A_PROVISION, Data: endpoints}); err != nil {
 			log.Printf("Error provisioning iot --> %v", err)
 		}
 	}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const shutdownListenerTimeout = 10 * time.Second
+
+// watchSignals function handle process signals, SIGHUP reload configuration, SIGINT and SIGTERM stop server
+func (ks *KiteServer) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			signal.Stop(signals)
+			ks.shutdown(fmt.Sprintf("%v received", sig))
+			return
+		}
+		if err := ks.reload(); err != nil {
+			log.Printf("Error reloading configuration --> %v", err)
+			ks.sendToTelegram(fmt.Sprintf("Server %s configuration not reloaded --> %v", ks.config().Address, err))
+		} else {
+			log.Printf("Configuration reloaded from %s", ks.configFile)
+			ks.sendToTelegram(fmt.Sprintf("Server %s configuration reloaded...", ks.config().Address))
+		}
+	}
+}
+
+// reload function read configuration file again and apply it without dropping websocket sessions. Settings read
+// on each use (check_origin, Telegram, log...) apply directly, listener is swapped when its address or
+// certificates change and database is reconnected when its settings change.
+func (ks *KiteServer) reload() error {
+	ks.restart.Lock()
+	defer ks.restart.Unlock()
+	if ks.shuttingDown() {
+		return errors.New("server is shutting down")
+	}
+
+	// Keeping server alive while listener is swapped
+	ks.wg.Add(1)
+	defer ks.wg.Done()
+
+	conf := loadConfig(ks.configFile)
+	if conf == nil {
+		return fmt.Errorf("invalid configuration file %s", ks.configFile)
+	}
+	if conf.SetupMode != ks.config().SetupMode {
+		return errors.New("setup_mode can't be changed by reload, server must be restarted")
+	}
+
+	previous := ks.config()
+	ks.setConfig(*conf)
+
+	// restore function go back to previous configuration when new one can't be applied
+	restore := func(reconnect bool) {
+		ks.setConfig(previous)
+		if reconnect {
+			if err := ks.connectDatabase(); err != nil {
+				log.Printf("Error connecting previous database --> %v", err)
+			}
+		}
+	}
+
+	reconnect := !ks.config().SetupMode && databaseChanged(previous, ks.config())
+	if reconnect {
+		// Current store is kept until new one is connected
+		if err := ks.connectDatabase(); err != nil {
+			restore(false)
+			return fmt.Errorf("connecting database --> %v", err)
+		}
+	}
+
+	// Certificates files can be renewed without being renamed, listener is always swapped with ssl
+	if ks.config().Ssl || ks.config().Server != previous.Server || ks.config().Port != previous.Port || ks.config().Ssl != previous.Ssl {
+		if err := ks.swapListener(previous); err != nil {
+			restore(reconnect)
+			return err
+		}
+	}
+
+	ks.configureLog()
+	ks.setTelegram(TmeConf{})
+	ks.routes()
+	if !ks.config().SetupMode {
+		ks.configureTelegram()
+	}
+	return nil
+}
+
+// swapListener function listen with new configuration and stop previous listener, hijacked websocket connections
+// are not closed by shutdown. New listener is opened first, except if address is the same (port is still in use).
+func (ks *KiteServer) swapListener(previous ServerConf) error {
+	old := ks.srv
+	sameAddress := ks.config().Server == previous.Server && ks.config().Port == previous.Port
+
+	if sameAddress {
+		stopListening(old)
+	}
+	listener, err := ks.listen()
+	if err != nil {
+		if sameAddress {
+			// Listening again with previous configuration
+			current := ks.config()
+			ks.setConfig(previous)
+			if listener, err := ks.listen(); err == nil {
+				ks.startServer(listener)
+			} else {
+				log.Printf("Error listening with previous configuration --> %v", err)
+			}
+			ks.setConfig(current)
+		}
+		return err
+	}
+	ks.startServer(listener)
+	if !sameAddress {
+		stopListening(old)
+	}
+	log.Printf("kite server %s listening on %s\n", ks.config().Server, ks.srv.Addr)
+	return nil
+}
+
+// stopListening function close listener of server and wait end of pending http requests
+func stopListening(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownListenerTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down listener --> %v", err)
+	}
+}
+
+// databaseChanged function check if connection settings used by database driver differ, a bolt file can't be
+// opened twice so bolt store is reconnected only when its file changes
+func databaseChanged(previous ServerConf, conf ServerConf) bool {
+	driver := strings.ToLower(conf.DatabaseDriver)
+	if strings.ToLower(previous.DatabaseDriver) != driver {
+		return true
+	}
+	switch driver {
+	case D_BOLT:
+		previousFile, _ := filepath.Abs(previous.databaseFile())
+		file, _ := filepath.Abs(conf.databaseFile())
+		return previousFile != file
+	case D_MEMORY:
+		return false
+	default:
+		return previous.DatabaseServer != conf.DatabaseServer ||
+			previous.DatabaseName != conf.DatabaseName ||
+			previous.DatabaseUsername != conf.DatabaseUsername ||
+			previous.DatabasePassword != conf.DatabasePassword
+	}
+}
+
+// configureLog function send log to configured file or else standard error, file is reopened on reload so log
+// files can be rotated
+func (ks *KiteServer) configureLog() {
+	previous := ks.logFile
+	ks.logFile = nil
+
+	if ks.config().LogFile == "" {
+		log.SetOutput(os.Stderr)
+	} else if file, err := os.OpenFile(ks.config().LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640); err != nil {
+		log.SetOutput(os.Stderr)
+		log.Printf("Error opening log file --> %v", err)
+	} else {
+		ks.logFile = file
+		log.SetOutput(file)
+	}
+
+	if previous != nil {
+		_ = previous.Close()
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	telegram := filepath.Join(dir, "telegram.json")
+	_ = ioutil.WriteFile(telegram, []byte(`{}`), 0600)
+	configFile := filepath.Join(dir, "default.json")
+	writeConfig := func(extra string) {
+		_ = ioutil.WriteFile(configFile, []byte(`{"server": "127.0.0.1", "port": "0", "database_driver": "memory",
+			"address": {"domain": "test", "type": "server", "host": "kite", "address": "*", "id": "*"},
+			"telegram_conf": "`+telegram+`"`+extra+`}`), 0600)
+	}
+	writeConfig("")
+
+	ks, _ := newTestServer(t, func(conf *ServerConf) {
+		conf.Server = "127.0.0.1"
+		conf.Port = "0"
+	})
+	ks.configFile = configFile
+	listener, err := ks.listen()
+	if err != nil {
+		t.Fatalf("listening --> %v", err)
+	}
+	ks.startServer(listener)
+	t.Cleanup(func() {
+		stopListening(ks.srv)
+		log.SetOutput(os.Stderr)
+		if ks.logFile != nil {
+			_ = ks.logFile.Close()
+		}
+	})
+
+	// server function return test server for current listener address
+	server := func() *httptest.Server {
+		return &httptest.Server{URL: "http://" + ks.srv.Addr}
+	}
+	iot := connect(t, ks, server(), testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, server(), testBrowserAddress, testBrowserKey)
+	previous := ks.srv.Addr
+
+	// Free port for new listener
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(free.Addr().String())
+	_ = free.Close()
+
+	logFile := filepath.Join(dir, "kite.log")
+	writeConfig(`, "port": "` + port + `", "check_origin": true, "log_file": "` + logFile + `"`)
+	if err := ks.reload(); err != nil {
+		t.Fatalf("reloading --> %v", err)
+	}
+
+	if !ks.config().CheckOrigin {
+		t.Error("check_origin not reloaded")
+	}
+	if ks.srv.Addr != "127.0.0.1:"+port {
+		t.Errorf("listening on %s, want port %s", ks.srv.Addr, port)
+	}
+	if conn, err := net.Dial("tcp", previous); err == nil {
+		_ = conn.Close()
+		t.Errorf("previous listener %s still open", previous)
+	}
+
+	// Sessions opened before reload are still connected
+	browser.send(t, kite.A_NOTIFY, address("test.iot.sensor.*.*"), "after reload")
+	if msg := iot.expect(t, kite.A_NOTIFY); msg.Data != "after reload" {
+		t.Errorf("got %v data, want after reload", msg.Data)
+	}
+
+	// New sessions use new listener
+	admin := connect(t, ks, server(), testAdminAddress, testAdminKey)
+	admin.send(t, kite.A_LOG, ks.config().Address, "written after reload")
+	waitFor(t, "log written to "+logFile, func() bool {
+		content, _ := ioutil.ReadFile(logFile)
+		return strings.Contains(string(content), "written after reload")
+	})
+
+	// Invalid configuration keeps current one
+	writeConfig(`, "port": "invalid"`)
+	current := ks.srv.Addr
+	if err := ks.reload(); err == nil {
+		t.Error("invalid configuration reloaded")
+	}
+	if ks.srv.Addr != current || !ks.config().CheckOrigin {
+		t.Error("current configuration changed by invalid reload")
+	}
+}
+
+func TestDatabaseSwap(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	// Sessions keep writing while database is reconnected, store is never seen nil
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for idx := 0; idx < 50; idx++ {
+			_ = admin.conn.WriteJSON(kite.Message{Action: kite.A_LOG, Sender: admin.address, Receiver: ks.config().Address, Data: "swapping"})
+		}
+	}()
+	for idx := 0; idx < 10; idx++ {
+		if err := ks.connectDatabase(); err != nil {
+			t.Fatalf("reconnecting database --> %v", err)
+		}
+	}
+	<-done
+
+	// Failed connection keeps current store
+	current := ks.store()
+	conf := ks.config()
+	conf.DatabaseDriver = "redis"
+	ks.setConfig(conf)
+	if err := ks.connectDatabase(); err == nil || ks.store() != current {
+		t.Errorf("failed connection --> %v, store replaced %v", err, ks.store() != current)
+	}
+	admin.send(t, A_PRESENCE, ks.config().Address, testAdminAddress)
+	admin.expect(t, A_PRESENCE)
+}
+
+// TestDatabaseChanged check only settings used by database driver trigger a reconnection
+func TestDatabaseChanged(t *testing.T) {
+	bolt := ServerConf{DatabaseDriver: D_BOLT, DatabaseServer: "cluster.example.com", DatabaseName: "kite"}
+	for _, tc := range []struct {
+		name    string
+		conf    func(ServerConf) ServerConf
+		changed bool
+	}{
+		{"unchanged", func(c ServerConf) ServerConf { return c }, false},
+		{"bolt ignores server", func(c ServerConf) ServerConf { c.DatabaseServer = "other"; c.DatabaseName = "other"; return c }, false},
+		{"bolt default file", func(c ServerConf) ServerConf { c.DatabaseFile = defaultDatabaseFile; return c }, false},
+		{"bolt file", func(c ServerConf) ServerConf { c.DatabaseFile = "./data/other.db"; return c }, true},
+		{"driver case", func(c ServerConf) ServerConf { c.DatabaseDriver = "Bolt"; return c }, false},
+		{"driver", func(c ServerConf) ServerConf { c.DatabaseDriver = D_MEMORY; return c }, true},
+	} {
+		if changed := databaseChanged(bolt, tc.conf(bolt)); changed != tc.changed {
+			t.Errorf("%s: databaseChanged = %v, want %v", tc.name, changed, tc.changed)
+		}
+	}
+
+	mongo := ServerConf{DatabaseServer: "cluster.example.com", DatabaseName: "kite"}
+	other := mongo
+	other.DatabaseFile = "./data/other.db"
+	if databaseChanged(mongo, other) {
+		t.Error("mongo reconnected on bolt file change")
+	}
+	other.DatabaseName = "other"
+	if !databaseChanged(mongo, other) {
+		t.Error("mongo not reconnected on database name change")
+	}
+}
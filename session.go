@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"strings"
+)
+
+const (
+	// Duplicate session policies, applied when a new connection registers an address already connected
+	P_KICK   = "kick"
+	P_REJECT = "reject"
+	P_ALLOW  = "allow"
+)
+
+// sessionPolicy function return policy applied to duplicate sessions, sessions coexist by default as they always did
+func (c ServerConf) sessionPolicy() string {
+	if c.SessionPolicy == "" {
+		return P_ALLOW
+	}
+	return strings.ToLower(c.SessionPolicy)
+}
+
+// sessions function return connected observers registered with address, observers lock must be held
+func (ks *KiteServer) sessions(address kite.Address) []*AddressObs {
+	var sessions []*AddressObs
+	for o := range ks.address.Observers {
+		if obs := o.(*AddressObs); obs.address == address {
+			sessions = append(sessions, obs)
+		}
+	}
+	return sessions
+}
+
+// kick function close session replaced by a new connection of its address
+func (o *AddressObs) kick(by *AddressObs) {
+	reason := fmt.Sprintf("session replaced by new connection from %s", by.conn.RemoteAddr())
+	log.Printf("Session of %s from %s kicked --> %s", o.address, o.conn.RemoteAddr(), reason)
+	o.OnClose(kite.Event{Data: reason})
+	_ = o.conn.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+func TestSessionPolicy(t *testing.T) {
+	sessions := func(ks *KiteServer, address kite.Address) int {
+		ks.observers.RLock()
+		defer ks.observers.RUnlock()
+		return len(ks.sessions(address))
+	}
+
+	t.Run("kick", func(t *testing.T) {
+		ks, srv := newTestServer(t, func(conf *ServerConf) { conf.SessionPolicy = P_KICK })
+		old := connect(t, ks, srv, testIotAddress, testIotKey)
+		old.expect(t, kite.A_PROVISION)
+		connect(t, ks, srv, testIotAddress, testIotKey)
+
+		_, err := old.receive()
+		if ce, ok := err.(*websocket.CloseError); !ok || !strings.HasPrefix(ce.Text, "session replaced") {
+			t.Errorf("kicked session got %v, want close with reason", err)
+		}
+		waitFor(t, "single session", func() bool { return sessions(ks, old.address) == 1 })
+		if presences := ks.whoIsOnline(old.address); len(presences) != 1 || !presences[0].Online {
+			t.Errorf("presence after kick %+v, want online", presences)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		ks, srv := newTestServer(t, func(conf *ServerConf) { conf.SessionPolicy = P_REJECT })
+		connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+		// New session is never accepted
+		c, msg, err := dial(t, srv, testAdminAddress, testAdminKey)
+		if err != nil || msg.Action != A_ERROR || errorCode(msg) != E_DUPLICATE_SESSION {
+			t.Fatalf("got %s %v (%v), want %s %s", msg.Action, msg.Data, err, A_ERROR, E_DUPLICATE_SESSION)
+		}
+		if _, err := c.receive(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("rejected session got %v, want policy violation close", err)
+		}
+		if n := sessions(ks, c.address); n != 1 {
+			t.Errorf("got %d sessions, want 1", n)
+		}
+	})
+
+	// Default policy keeps duplicate sessions connected
+	t.Run("allow", func(t *testing.T) {
+		ks, srv := newTestServer(t)
+		first := connect(t, ks, srv, testAdminAddress, testAdminKey)
+		connect(t, ks, srv, testAdminAddress, testAdminKey)
+		waitFor(t, "two sessions", func() bool { return sessions(ks, first.address) == 2 })
+	})
+}
@@ -5,47 +5,371 @@ import (
 	"fmt"
 	kite "github.com/get-code-ch/kite-common"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-// function setupServer get setting from client (browser or cli tools)
-func (ks *KiteServer) setupServer(msg kite.Message, this *AddressObs) error {
+type (
+	// SetupReport is the outcome of setup sent back to client
+	SetupReport struct {
+		Status string            `json:"status"`
+		Error  string            `json:"error,omitempty"`
+		Files  []SetupFileReport `json:"files,omitempty"`
+	}
 
-	data := kite.SetupMessage{}
-	data = data.SetFromInterface(msg.Data)
+	// SetupFileReport is the result of writing one setup file
+	SetupFileReport struct {
+		Path    string `json:"path"`
+		Success bool   `json:"success"`
+		Error   string `json:"error,omitempty"`
+	}
 
-	// we accept only setting up if Apikey is correctly configured
-	if data.ApiKey != ks.conf.ApiKey {
-		ks.address.Notify(kite.Event{Data: fmt.Sprintf("Sorry, you are not authorized to setup server...")}, this, msg.Sender)
+	setupBackup struct {
+		path    string
+		existed bool
+		content []byte
+	}
+)
+
+const (
+	defaultSetupRoot = "."
+
+	// Setup status definition
+	S_SETUP_APPLIED     = "applied"
+	S_SETUP_REJECTED    = "rejected"
+	S_SETUP_ROLLED_BACK = "rolled_back"
+	S_SETUP_FAILED      = "failed"
+)
+
+// setupServer function get setting from client (browser or cli tools), new configuration is validated and
+// applied, previous files are restored if server can't restart with it
+func (ks *KiteServer) setupServer(msg Envelope, this *AddressObs) error {
+
+	// Payload is decoded and validated by waitMessage
+	data, _ := msg.Data.(kite.SetupMessage)
+
+	// we accept only setting up if Apikey is correctly configured (configured value can be a bcrypt hash)
+	if !checkSecret(ks.config().ApiKey, data.ApiKey) {
+		ks.replyError(this, msg, ErrorReply{Code: E_UNAUTHORIZED, Message: "not authorized to setup server"})
 		return errors.New("invalid ApiKey")
 	}
 
-	// Importing and saving configuration files
-	for _, file := range data.SetupFiles {
-		folder := filepath.Dir(file.Path)
-		if _, err := os.Stat(folder); err != nil {
-			if os.IsNotExist(err) {
-				os.Mkdir(folder, os.ModeDir)
-			}
+	report := SetupReport{Status: S_SETUP_REJECTED}
+	defer func() {
+		ks.reportSetup(report, this)
+	}()
+
+	// Validating new configuration before anything is written
+	if err := ks.validateSetup(data.SetupFiles); err != nil {
+		report.Error = err.Error()
+		return err
+	}
+
+	// Saving previous files then importing new ones, setup is aborted if a file can't be written
+	backups, err := ks.backupSetupFiles(data.SetupFiles)
+	if err != nil {
+		report.Error = err.Error()
+		return err
+	}
+	report.Files, err = ks.writeSetupFiles(data.SetupFiles)
+	if err != nil {
+		ks.restoreSetupFiles(backups)
+		report.Error = err.Error()
+		return err
+	}
+
+	// Sending restart notification to all clients, websocket connections are kept during restart
+	ks.notify(kite.Event{Data: fmt.Sprintf("Server is provisioned and is restarting...")}, this, kite.Address{Domain: "*", Type: "*", Host: "*", Address: "*", Id: "*"})
+	if err := ks.restartServer(); err != nil {
+		log.Printf("Error restarting server with new setup, rolling back --> %v", err)
+		ks.restoreSetupFiles(backups)
+		if rollbackErr := ks.restartServer(); rollbackErr != nil {
+			log.Printf("Error restarting server with previous setup --> %v", rollbackErr)
+			report.Status = S_SETUP_FAILED
+			report.Error = fmt.Sprintf("%v, previous setup can't be restarted --> %v", err, rollbackErr)
+			return err
 		}
-		ioutil.WriteFile(file.Path, file.Content, 0744)
+		report.Status = S_SETUP_ROLLED_BACK
+		report.Error = err.Error()
+		return err
 	}
 
-	// Sending restart notification to all clients
-	ks.address.Notify(kite.Event{Data: fmt.Sprintf("Server is provisioned and is restarting...")}, this, kite.Address{Domain: "*", Type: "*", Host: "*", Address: "*", Id: "*"})
-	ks.address.Close(kite.Event{Data: "Setup done"})
-	ks.srv.Shutdown(ks.ctx)
+	report.Status = S_SETUP_APPLIED
+	return nil
+}
+
+// reportSetup function send setup outcome to client and Telegram, then close clients to reconnect with new setup
+func (ks *KiteServer) reportSetup(report SetupReport, this *AddressObs) {
+	if err := this.write(Envelope{Message: kite.Message{Action: kite.A_SETUP, Sender: ks.config().Address, Receiver: this.address, Data: report}}); err != nil {
+		log.Printf("Error sending setup report to %s --> %v", this.address, err)
+	}
 
-	// Reloading configuration
-	ks.conf = *loadConfig("")
-	ks.connectDatabase()
-	ks.configureTelegram()
+	switch report.Status {
+	case S_SETUP_APPLIED:
+		ks.sendToTelegram("Server is provisioned and restarted...")
+		ks.closeAll(kite.Event{Data: "Setup done"})
+	case S_SETUP_ROLLED_BACK:
+		ks.sendToTelegram(fmt.Sprintf("Server setup failed, previous configuration restored --> %s", report.Error))
+		ks.closeAll(kite.Event{Data: "Setup rolled back"})
+	case S_SETUP_FAILED:
+		// Server is left without listener, it is stopped with an error so its supervisor restarts it
+		ks.sendToTelegram(fmt.Sprintf("Server setup failed and server can't restart, stopping --> %s", report.Error))
+		go ks.fail("setup failed, server can't restart")
+	default:
+		ks.sendToTelegram(fmt.Sprintf("Server setup rejected --> %s", report.Error))
+	}
+}
 
+// restartServer function shut down listener and start again with configuration file, database and Telegram
+func (ks *KiteServer) restartServer() error {
+	ks.restart.Lock()
+	defer ks.restart.Unlock()
+	if ks.shuttingDown() {
+		return errors.New("server is shutting down")
+	}
 
+	// Keeping server alive during restart
 	ks.wg.Add(1)
-	ks.startServer()
-	ks.sendToTelegram("Server is provisioned and is restarting...")
+	defer ks.wg.Done()
+
+	// Hijacked websocket connections are not closed by shutdown
+	stopListening(ks.srv)
 
+	conf := loadConfig(ks.configFile)
+	if conf == nil {
+		return fmt.Errorf("invalid configuration file %s", ks.configFile)
+	}
+	previous := ks.config()
+	ks.setConfig(*conf)
+	ks.configureLog()
+	ks.setTelegram(TmeConf{})
+	ks.routes()
+
+	if !ks.config().SetupMode {
+		// Current store is kept when database settings are unchanged (bolt file can't be opened twice)
+		if ks.store() == nil || databaseChanged(previous, ks.config()) {
+			if err := ks.connectDatabase(); err != nil {
+				return fmt.Errorf("connecting database --> %v", err)
+			}
+		}
+		ks.configureTelegram()
+	}
+
+	listener, err := ks.listen()
+	if err != nil {
+		return err
+	}
+	ks.startServer(listener)
+	log.Printf("kite server %s listening on port %s\n", ks.config().Server, ks.config().Port)
 	return nil
 }
+
+// validateSetup function check staged configuration (or current one if not provided) and Telegram configuration
+func (ks *KiteServer) validateSetup(files []kite.SetupFile) error {
+	root := ks.setupRoot()
+	staged := make(map[string][]byte)
+	for _, file := range files {
+		path, err := confinedPath(root, file.Path)
+		if err != nil {
+			return err
+		}
+		staged[path] = file.Content
+	}
+
+	// stagedOrRead return staged content of file or else its current content
+	stagedOrRead := func(file string) ([]byte, error) {
+		if path, err := confinedPath(root, file); err == nil {
+			if content, ok := staged[path]; ok {
+				return content, nil
+			}
+		}
+		return ioutil.ReadFile(file)
+	}
+
+	content, err := stagedOrRead(ks.configFile)
+	if err != nil {
+		return fmt.Errorf("reading configuration --> %v", err)
+	}
+	conf, err := parseConfig(content)
+	if err != nil {
+		return fmt.Errorf("parsing configuration --> %v", err)
+	}
+	if err := conf.applyOverrides(os.LookupEnv, commandLine); err != nil {
+		return err
+	}
+	// Files referenced by configuration (certificates, Telegram configuration) can be part of setup
+	return conf.validate(stagedOrRead)
+}
+
+// backupSetupFiles function keep current content of files replaced by setup, also saved as .bak file
+func (ks *KiteServer) backupSetupFiles(files []kite.SetupFile) ([]setupBackup, error) {
+	backups := make([]setupBackup, 0, len(files))
+	for _, file := range files {
+		path, err := confinedPath(ks.setupRoot(), file.Path)
+		if err != nil {
+			return nil, err
+		}
+		backup := setupBackup{path: path}
+		if content, err := ioutil.ReadFile(path); err == nil {
+			backup.existed = true
+			backup.content = content
+			if err := writeFileAtomic(path+".bak", content, setupFileMode(path)); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// restoreSetupFiles function put back files saved before setup
+func (ks *KiteServer) restoreSetupFiles(backups []setupBackup) {
+	for _, backup := range backups {
+		var err error
+		if backup.existed {
+			err = writeFileAtomic(backup.path, backup.content, setupFileMode(backup.path))
+		} else if err = os.Remove(backup.path); os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Error restoring %s --> %v", backup.path, err)
+		}
+	}
+}
+
+func (ks *KiteServer) setupRoot() string {
+	if ks.config().SetupRoot == "" {
+		return defaultSetupRoot
+	}
+	return ks.config().SetupRoot
+}
+
+// writeSetupFiles function write each setup file inside setup root and report result per file
+func (ks *KiteServer) writeSetupFiles(files []kite.SetupFile) ([]SetupFileReport, error) {
+	var failed []string
+	reports := make([]SetupFileReport, 0, len(files))
+
+	for _, file := range files {
+		report := SetupFileReport{Path: file.Path, Success: true}
+		if err := ks.writeSetupFile(file); err != nil {
+			report.Success = false
+			report.Error = err.Error()
+			failed = append(failed, file.Path)
+			log.Printf("Error writing setup file %s --> %v", file.Path, err)
+		}
+		reports = append(reports, report)
+	}
+
+	if len(failed) > 0 {
+		return reports, fmt.Errorf("error writing setup files %s", strings.Join(failed, ", "))
+	}
+	return reports, nil
+}
+
+// writeSetupFile function write a setup file confined in setup root
+func (ks *KiteServer) writeSetupFile(file kite.SetupFile) error {
+	root := ks.setupRoot()
+
+	path, err := confinedPath(root, file.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	// Checking again once folders exist, a symbolic link could have been created meanwhile
+	if _, err := confinedPath(root, file.Path); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, file.Content, setupFileMode(path))
+}
+
+// writeFileAtomic function write content to a temporary file renamed once complete
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".setup-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// confinedPath function resolve path relatively to root and reject paths (or symbolic links) escaping root
+func confinedPath(root string, path string) (string, error) {
+	if path == "" {
+		return "", errors.New("empty setup file path")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+
+	target := filepath.Clean(path)
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(root, target)
+	}
+	if !within(root, target) {
+		return "", fmt.Errorf("%s is outside setup root", path)
+	}
+
+	// Resolving symbolic links of deepest existing folder
+	folder := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(folder); err == nil {
+			break
+		}
+		folder = filepath.Dir(folder)
+	}
+	resolved, err := filepath.EvalSymlinks(folder)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, resolved) {
+		return "", fmt.Errorf("%s is linked outside setup root", path)
+	}
+
+	// Existing target must be a regular file
+	if info, err := os.Lstat(target); err == nil && !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	return target, nil
+}
+
+func within(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// setupFileMode function return file permission, only certificates are readable by others (keys and configurations hold secrets)
+func setupFileMode(path string) os.FileMode {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".crt", ".cer":
+		return 0644
+	default:
+		return 0600
+	}
+}
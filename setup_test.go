@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+)
+
+func TestWriteSetupFiles(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatalf("creating symbolic link --> %v", err)
+	}
+
+	ks := newKiteServer(ServerConf{SetupRoot: root})
+	reports, err := ks.writeSetupFiles([]kite.SetupFile{
+		{Path: "config/nested/default.json", Content: []byte("{}")},
+		{Path: "./ssl/server.key", Content: []byte("key")},
+		{Path: "ssl/server.crt", Content: []byte("crt")},
+		{Path: "../escape.json", Content: []byte("{}")},
+		{Path: filepath.Join(outside, "absolute.json"), Content: []byte("{}")},
+		{Path: "link/linked.json", Content: []byte("{}")},
+	})
+	if err == nil {
+		t.Error("setup with rejected files should return an error")
+	}
+
+	for idx, success := range []bool{true, true, true, false, false, false} {
+		if reports[idx].Success != success {
+			t.Errorf("%s written %v, want %v (%s)", reports[idx].Path, reports[idx].Success, success, reports[idx].Error)
+		}
+	}
+	for path, mode := range map[string]os.FileMode{"config/nested/default.json": 0600, "ssl/server.key": 0600, "ssl/server.crt": 0644} {
+		if info, err := os.Stat(filepath.Join(root, path)); err != nil || info.Mode().Perm() != mode {
+			t.Errorf("%s --> %v, %v, want mode %v", path, info, err, mode)
+		}
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 0 {
+		t.Errorf("%d files written outside setup root", len(files))
+	}
+	if files, _ := filepath.Glob(filepath.Join(root, "*", ".setup-*")); len(files) != 0 {
+		t.Errorf("temporary files left %v", files)
+	}
+}
+
+func TestSetupRollback(t *testing.T) {
+	root := t.TempDir()
+	configFile := filepath.Join(root, "config", "setup.json")
+	common := `"setup_mode": true, "server": "127.0.0.1", "api_key": "setup-api-key", "setup_root": "` + root + `"`
+	current := []byte(`{` + common + `, "port": "0"}`)
+	_ = os.MkdirAll(filepath.Dir(configFile), 0750)
+	_ = ioutil.WriteFile(configFile, current, 0600)
+
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.SetupMode = true
+		conf.SetupRoot = root
+		conf.ApiKey = "setup-api-key"
+	})
+	ks.configFile = configFile
+	t.Cleanup(func() {
+		if ks.srv != nil {
+			_ = ks.srv.Shutdown(ks.ctx)
+		}
+	})
+
+	// Occupied port make restart fail
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening --> %v", err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		status string
+	}{
+		{"invalid", `{"setup_mode": true, "port": `, S_SETUP_REJECTED},
+		{"missing port", `{"setup_mode": true}`, S_SETUP_REJECTED},
+		{"busy port", `{` + common + `, "port": "` + busyPort + `"}`, S_SETUP_ROLLED_BACK},
+		{"applied", `{` + common + `, "port": "0", "description": "applied"}`, S_SETUP_APPLIED},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before, _ := ioutil.ReadFile(configFile)
+
+			c := connect(t, ks, srv, testAdminAddress, testAdminKey)
+			c.send(t, kite.A_SETUP, ks.config().Address, kite.SetupMessage{ApiKey: "setup-api-key", SetupFiles: []kite.SetupFile{{Path: "config/setup.json", Content: []byte(tc.config)}}})
+
+			// Restart notification is received before setup report
+			msg, err := c.receive()
+			for err == nil && msg.Action != kite.A_SETUP {
+				msg, err = c.receive()
+			}
+			if err != nil {
+				t.Fatalf("waiting setup report --> %v", err)
+			}
+			if report, _ := msg.Data.(map[string]interface{}); report["status"] != tc.status {
+				t.Errorf("setup report %v, want status %s", report, tc.status)
+			}
+
+			content, _ := ioutil.ReadFile(configFile)
+			if tc.status == S_SETUP_APPLIED {
+				if string(content) != tc.config {
+					t.Errorf("configuration not applied --> %s", content)
+				}
+			} else if string(content) != string(before) {
+				t.Errorf("configuration not restored --> %s", content)
+			}
+		})
+	}
+}
+
+func TestSetupRollbackFailed(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening --> %v", err)
+	}
+	defer busy.Close()
+	_, busyPort, _ := net.SplitHostPort(busy.Addr().String())
+
+	// Previous configuration can't be restarted either
+	root := t.TempDir()
+	configFile := filepath.Join(root, "config", "setup.json")
+	common := `"setup_mode": true, "server": "127.0.0.1", "api_key": "setup-api-key", "setup_root": "` + root + `", "shutdown_timeout": 1`
+	_ = os.MkdirAll(filepath.Dir(configFile), 0750)
+	_ = ioutil.WriteFile(configFile, []byte(`{`+common+`, "port": "`+busyPort+`", "description": "previous"}`), 0600)
+
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.SetupMode = true
+		conf.SetupRoot = root
+		conf.ApiKey = "setup-api-key"
+	})
+	ks.configFile = configFile
+
+	c := connect(t, ks, srv, testAdminAddress, testAdminKey)
+	c.send(t, kite.A_SETUP, ks.config().Address, kite.SetupMessage{ApiKey: "setup-api-key", SetupFiles: []kite.SetupFile{{Path: "config/setup.json", Content: []byte(`{` + common + `, "port": "` + busyPort + `"}`)}}})
+	msg, err := c.receive()
+	for err == nil && msg.Action != kite.A_SETUP {
+		msg, err = c.receive()
+	}
+	if err != nil {
+		t.Fatalf("waiting setup report --> %v", err)
+	}
+	if report, _ := msg.Data.(map[string]interface{}); report["status"] != S_SETUP_FAILED {
+		t.Errorf("setup report %v, want status %s", report, S_SETUP_FAILED)
+	}
+
+	// Server without listener is stopped with an error
+	select {
+	case <-ks.stopped:
+		if !ks.failed {
+			t.Error("server stopped without failure")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server not stopped")
+	}
+}
+
+func TestSetupWithoutApiKey(t *testing.T) {
+	ks, srv := newTestServer(t)
+	admin := connect(t, ks, srv, testAdminAddress, testAdminKey)
+
+	// Server without api key can't be set up, even with an empty key
+	admin.send(t, kite.A_SETUP, ks.config().Address, kite.SetupMessage{ApiKey: "", SetupFiles: []kite.SetupFile{{Path: "config/setup.json", Content: []byte(`{}`)}}})
+	if code := errorCode(admin.expect(t, A_ERROR)); code != E_UNAUTHORIZED {
+		t.Errorf("got %s error code, want %s", code, E_UNAUTHORIZED)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"log"
+	"os"
+	"time"
+)
+
+const defaultShutdownTimeout = 10
+
+// shutdown function stop server gracefully: new connections are refused, connected addresses receive a close frame,
+// messages waiting acknowledgement are queued and connections are waited until shutdown timeout
+func (ks *KiteServer) shutdown(reason string) {
+	// No more new connections, reload or setup restart can't start listening again once stopping
+	ks.restart.Lock()
+	if ks.shuttingDown() {
+		ks.restart.Unlock()
+		return
+	}
+	close(ks.stopping)
+	log.Printf("Server shutting down --> %s", reason)
+	stopListening(ks.srv)
+	ks.restart.Unlock()
+
+	ks.closeAll(kite.Event{Data: fmt.Sprintf("Server is shutting down (%s)", reason)})
+
+	// Messages not yet acknowledged will be delivered on next connection, pending commands are abandoned
+	ks.flushDeliveries()
+	ks.flushRequests()
+
+	// Waiting read and ping goroutines end, connections not closed by clients in time are dropped
+	done := make(chan struct{})
+	go func() {
+		ks.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		break
+	case <-time.After(ks.shutdownTimeout()):
+		log.Printf("Shutdown timeout reached, dropping remaining connections")
+		ks.dropAll()
+		<-done
+	}
+
+	if db := ks.store(); db != nil {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing database --> %v", err)
+		}
+	}
+	ks.sendToTelegram(fmt.Sprintf("Server %s is stopped...", ks.config().Address))
+	log.Printf("Server stopped")
+
+	if ks.logFile != nil {
+		log.SetOutput(os.Stderr)
+		_ = ks.logFile.Sync()
+		_ = ks.logFile.Close()
+		ks.logFile = nil
+	}
+	close(ks.stopped)
+}
+
+// fail function shut down server which can't run anymore, server exits with an error code
+func (ks *KiteServer) fail(reason string) {
+	ks.restart.Lock()
+	ks.failed = true
+	ks.restart.Unlock()
+	ks.shutdown(reason)
+}
+
+// shuttingDown function check if server is stopping
+func (ks *KiteServer) shuttingDown() bool {
+	select {
+	case <-ks.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// flushDeliveries function stop delivery retries and queue messages not acknowledged by their receiver
+func (ks *KiteServer) flushDeliveries() {
+	ks.deliveries.sync.Lock()
+	pending := ks.deliveries.pending
+	ks.deliveries.pending = map[string]*pendingDelivery{}
+	ks.deliveries.sync.Unlock()
+
+	for _, p := range pending {
+		p.timer.Stop()
+		env := p.env
+		env.Receiver = p.receiver.address
+		if !ks.queueMessage(env) {
+			log.Printf("Message %s to %s not acknowledged and lost", env.Id, env.Receiver)
+		}
+	}
+}
+
+// flushRequests function abandon commands waiting a reply
+func (ks *KiteServer) flushRequests() {
+	ks.requests.sync.Lock()
+	defer ks.requests.sync.Unlock()
+
+	for id, p := range ks.requests.pending {
+		p.timer.Stop()
+		delete(ks.requests.pending, id)
+	}
+}
+
+// dropAll function close connection of every connected address without waiting close handshake
+func (ks *KiteServer) dropAll() {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+	for o := range ks.address.Observers {
+		_ = o.(*AddressObs).conn.Close()
+	}
+}
+
+func (ks *KiteServer) shutdownTimeout() time.Duration {
+	timeout := ks.config().ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
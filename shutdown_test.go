@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Delivery = ConfDelivery{Retries: 3, Timeout: 60}
+		conf.Outbox = ConfOutbox{Size: 10}
+		conf.ShutdownTimeout = 1
+	})
+	iot := connect(t, ks, srv, testIotAddress, testIotKey)
+	iot.expect(t, kite.A_PROVISION)
+	browser := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+
+	// Message never acknowledged by iot
+	browser.send(t, kite.A_NOTIFY, address(testIotAddress), "switch on")
+	iot.expect(t, kite.A_NOTIFY)
+	browser.expect(t, A_DELIVERY)
+
+	start := time.Now()
+	go ks.shutdown("test")
+
+	// Browser answer close handshake, iot doesn't read anymore and is dropped after timeout
+	if _, err := browser.receive(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected going away close, got %v", err)
+	} else if reason := err.(*websocket.CloseError).Text; reason != "Server is shutting down (test)" {
+		t.Errorf("close reason %q", reason)
+	}
+
+	select {
+	case <-ks.stopped:
+		if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+			t.Errorf("shutdown took %v, want about shutdown timeout", elapsed)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server not stopped")
+	}
+
+	if queued, _ := ks.db.QueuedMessages(address(testIotAddress)); len(queued) != 1 || queued[0].Message.Data != "switch on" {
+		t.Errorf("not acknowledged message not queued --> %v", queued)
+	}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	if _, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {srv.URL}}); err == nil || response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("connection after shutdown --> %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store interface is the persistence layer used by server (logs, address authorizations and endpoints)
+type Store interface {
+	// Connect open connection to the storage backend
+	Connect() error
+	// Close release storage backend resources
+	Close() error
+
+	// WriteLog append a new log message
+	WriteLog(logMessage kite.LogMessage) error
+	// ReadLog return log messages where address or message match filter regex
+	ReadLog(filter string) ([]kite.LogMessage, error)
+
+	// UpsertAddressAuth create or replace address authorization identified by its name
+	UpsertAddressAuth(addressAuth AddressAuth) error
+	// FindAddressAuth return first address authorization with name matching regex pattern
+	FindAddressAuth(pattern string) (AddressAuth, error)
+	// ListAddressAuth return all address authorizations
+	ListAddressAuth() ([]AddressAuth, error)
+	// ActivateAddress enable address authorization and clear its activation code
+	ActivateAddress(name string) error
+	// DeleteAddressAuth remove address authorization
+	DeleteAddressAuth(name string) error
+
+	// UpsertEndpoint create or replace endpoint identified by its name
+	UpsertEndpoint(endpoint kite.Endpoint) error
+	// FindEndpoint return endpoints with name matching regex pattern
+	FindEndpoint(pattern string) ([]kite.Endpoint, error)
+
+	// QueueMessage append message to outbox, oldest messages for same receiver are dropped above limit
+	QueueMessage(queued QueuedMessage, limit int) error
+	// QueuedMessages return, oldest first, queued messages deliverable to address
+	QueuedMessages(address kite.Address) ([]QueuedMessage, error)
+	// DeleteMessage remove message from outbox once delivered
+	DeleteMessage(id primitive.ObjectID) error
+	// PurgeMessages remove queued messages older than time limit
+	PurgeMessages(before time.Time) error
+
+	// UpsertPresence create or replace presence identified by its address
+	UpsertPresence(presence Presence) error
+	// ListPresence return presence of all known addresses
+	ListPresence() ([]Presence, error)
+}
+
+const (
+	// Database driver definition
+	D_MONGO  = "mongo"
+	D_BOLT   = "bolt"
+	D_MEMORY = "memory"
+)
+
+// ErrNotFound is returned by Store when requested document doesn't exist
+var ErrNotFound = errors.New("document not found")
+
+// newStore function return Store implementation selected by database_driver configuration
+func newStore(conf ServerConf) (Store, error) {
+	switch strings.ToLower(conf.DatabaseDriver) {
+	case "", D_MONGO:
+		return &MongoStore{conf: conf}, nil
+	case D_BOLT:
+		return &BoltStore{conf: conf}, nil
+	case D_MEMORY:
+		return &MemoryStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %s", conf.DatabaseDriver)
+	}
+}
+
+// sortQueued function order queued messages by time, messages queued again after a failed delivery keep their place
+func sortQueued(queued []QueuedMessage) {
+	sort.SliceStable(queued, func(i, j int) bool { return queued[i].Time.Before(queued[j].Time) })
+}
+
+// addressAuthPattern function return regex matching address authorization for address (full or host only)
+func addressAuthPattern(address string) string {
+	a := new(kite.Address)
+	a.StringToAddress(address)
+
+	regexAddress := `^`
+	regexAddress += a.Domain + `\.`
+	regexAddress += a.Type.String() + `\.`
+	regexAddress += a.Host + `\.`
+	if a.Address == "*" {
+		a.Address = `\*`
+	}
+	regexAddress += `(?:\*|` + a.Address + `)\.\*`
+	regexAddress += `$`
+
+	return regexAddress
+}
+
+// endpointPattern function return regex matching endpoints belonging to address host
+func endpointPattern(address kite.Address) string {
+	regexAddress := `^`
+	regexAddress += address.Domain + `\.`
+	regexAddress += kite.H_ENDPOINT.String() + `\.`
+	regexAddress += address.Host + `\..*$`
+
+	return regexAddress
+}
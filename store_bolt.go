@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	kite "github.com/get-code-ch/kite-common"
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// BoltStore is the embedded Store implementation keeping all collections in a single local file
+type BoltStore struct {
+	conf ServerConf
+	db   *bolt.DB
+}
+
+const defaultDatabaseFile = "./data/kite.db"
+
+// databaseFile function return bolt database file, default one when not configured
+func (c ServerConf) databaseFile() string {
+	if c.DatabaseFile == "" {
+		return defaultDatabaseFile
+	}
+	return c.DatabaseFile
+}
+
+func (s *BoltStore) Connect() error {
+	file := s.conf.databaseFile()
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	// Creating one bucket per collection
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, collection := range []kite.Collection{kite.C_LOG, kite.C_ADDRESSAUTH, kite.C_ENDPOINT, C_OUTBOX, C_PRESENCE} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(collection)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+func (s *BoltStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *BoltStore) WriteLog(logMessage kite.LogMessage) error {
+	if logMessage.Id.IsZero() {
+		logMessage.Id = primitive.NewObjectID()
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kite.C_LOG))
+
+		// Log messages are keyed by sequence to keep insertion order
+		key, err := nextKey(bucket)
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(logMessage)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	})
+}
+
+func (s *BoltStore) ReadLog(filter string) ([]kite.LogMessage, error) {
+	var messages []kite.LogMessage
+
+	re, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kite.C_LOG)).ForEach(func(k, v []byte) error {
+			logMessage := kite.LogMessage{}
+			if err := json.Unmarshal(v, &logMessage); err != nil {
+				return err
+			}
+			if re.MatchString(logMessage.Address) || re.MatchString(logMessage.Message) {
+				messages = append(messages, logMessage)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *BoltStore) UpsertAddressAuth(addressAuth AddressAuth) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kite.C_ADDRESSAUTH))
+
+		// Keeping existing document id on update
+		if current := bucket.Get([]byte(addressAuth.Name)); current != nil {
+			existing := AddressAuth{}
+			if err := json.Unmarshal(current, &existing); err == nil {
+				addressAuth.Id = existing.Id
+			}
+		}
+		if addressAuth.Id.IsZero() {
+			addressAuth.Id = primitive.NewObjectID()
+		}
+
+		value, err := json.Marshal(addressAuth)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(addressAuth.Name), value)
+	})
+}
+
+func (s *BoltStore) FindAddressAuth(pattern string) (AddressAuth, error) {
+	addressAuth := AddressAuth{}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return addressAuth, err
+	}
+
+	found := false
+	err = s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(kite.C_ADDRESSAUTH)).Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			if re.Match(k) {
+				found = true
+				return json.Unmarshal(v, &addressAuth)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return AddressAuth{}, err
+	}
+	if !found {
+		return AddressAuth{}, ErrNotFound
+	}
+	return addressAuth, nil
+}
+
+func (s *BoltStore) ListAddressAuth() ([]AddressAuth, error) {
+	var addressAuths []AddressAuth
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kite.C_ADDRESSAUTH)).ForEach(func(k, v []byte) error {
+			addressAuth := AddressAuth{}
+			if err := json.Unmarshal(v, &addressAuth); err != nil {
+				return err
+			}
+			addressAuths = append(addressAuths, addressAuth)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addressAuths, nil
+}
+
+func (s *BoltStore) ActivateAddress(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kite.C_ADDRESSAUTH))
+		current := bucket.Get([]byte(name))
+		if current == nil {
+			return ErrNotFound
+		}
+
+		addressAuth := AddressAuth{}
+		if err := json.Unmarshal(current, &addressAuth); err != nil {
+			return err
+		}
+		addressAuth.Enabled = true
+		addressAuth.ActivationCode = ""
+		value, err := json.Marshal(addressAuth)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(name), value)
+	})
+}
+
+func (s *BoltStore) DeleteAddressAuth(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kite.C_ADDRESSAUTH))
+		if bucket.Get([]byte(name)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (s *BoltStore) UpsertEndpoint(endpoint kite.Endpoint) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(kite.C_ENDPOINT))
+		if endpoint.Id.IsZero() {
+			endpoint.Id = primitive.NewObjectID()
+		}
+		value, err := json.Marshal(endpoint)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(endpoint.Name), value)
+	})
+}
+
+func (s *BoltStore) FindEndpoint(pattern string) ([]kite.Endpoint, error) {
+	var endpoints []kite.Endpoint
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(kite.C_ENDPOINT)).ForEach(func(k, v []byte) error {
+			if !re.Match(k) {
+				return nil
+			}
+			endpoint := kite.Endpoint{}
+			if err := json.Unmarshal(v, &endpoint); err == nil {
+				endpoints = append(endpoints, endpoint)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+func (s *BoltStore) QueueMessage(queued QueuedMessage, limit int) error {
+	if queued.Id.IsZero() {
+		queued.Id = primitive.NewObjectID()
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(C_OUTBOX))
+
+		key, err := nextKey(bucket)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(queued)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(key, value); err != nil {
+			return err
+		}
+
+		// Dropping oldest messages of receiver above limit
+		var keys [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			q := QueuedMessage{}
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			if q.Receiver == queued.Receiver {
+				keys = append(keys, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for idx := 0; idx < len(keys)-limit; idx++ {
+			if err := bucket.Delete(keys[idx]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) QueuedMessages(address kite.Address) ([]QueuedMessage, error) {
+	var queued []QueuedMessage
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(C_OUTBOX)).ForEach(func(k, v []byte) error {
+			q := QueuedMessage{}
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			if address.Match(q.Message.Receiver) {
+				queued = append(queued, q)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortQueued(queued)
+	return queued, nil
+}
+
+func (s *BoltStore) DeleteMessage(id primitive.ObjectID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(C_OUTBOX))
+
+		var key []byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			q := QueuedMessage{}
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			if q.Id == id {
+				key = k
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if key == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete(key)
+	})
+}
+
+func (s *BoltStore) PurgeMessages(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(C_OUTBOX))
+
+		var keys [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			q := QueuedMessage{}
+			if err := json.Unmarshal(v, &q); err != nil {
+				return err
+			}
+			if q.Time.Before(before) {
+				keys = append(keys, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// nextKey function return bucket next sequence as big endian key (keys are sorted in insertion order)
+func nextKey(bucket *bolt.Bucket) ([]byte, error) {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key, nil
+}
+
+func (s *BoltStore) UpsertPresence(presence Presence) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		value, err := json.Marshal(presence)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(C_PRESENCE)).Put([]byte(presence.Address), value)
+	})
+}
+
+func (s *BoltStore) ListPresence() ([]Presence, error) {
+	var presences []Presence
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(C_PRESENCE)).ForEach(func(k, v []byte) error {
+			presence := Presence{}
+			if err := json.Unmarshal(v, &presence); err != nil {
+				return err
+			}
+			presences = append(presences, presence)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return presences, nil
+}
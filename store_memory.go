@@ -0,0 +1,255 @@
+package main
+
+import (
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a volatile Store implementation, data are lost when server stop (tests and demo purpose)
+type MemoryStore struct {
+	sync         sync.RWMutex
+	logs         []kite.LogMessage
+	addressAuths []AddressAuth
+	endpoints    []kite.Endpoint
+	outbox       []QueuedMessage
+	presences    []Presence
+}
+
+func (s *MemoryStore) Connect() error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) WriteLog(logMessage kite.LogMessage) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	if logMessage.Id.IsZero() {
+		logMessage.Id = primitive.NewObjectID()
+	}
+	s.logs = append(s.logs, logMessage)
+	return nil
+}
+
+func (s *MemoryStore) ReadLog(filter string) ([]kite.LogMessage, error) {
+	var messages []kite.LogMessage
+
+	re, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	for _, logMessage := range s.logs {
+		if re.MatchString(logMessage.Address) || re.MatchString(logMessage.Message) {
+			messages = append(messages, logMessage)
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) UpsertAddressAuth(addressAuth AddressAuth) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx := range s.addressAuths {
+		if s.addressAuths[idx].Name == addressAuth.Name {
+			addressAuth.Id = s.addressAuths[idx].Id
+			s.addressAuths[idx] = addressAuth
+			return nil
+		}
+	}
+	if addressAuth.Id.IsZero() {
+		addressAuth.Id = primitive.NewObjectID()
+	}
+	s.addressAuths = append(s.addressAuths, addressAuth)
+	return nil
+}
+
+func (s *MemoryStore) FindAddressAuth(pattern string) (AddressAuth, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return AddressAuth{}, err
+	}
+
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	for _, addressAuth := range s.addressAuths {
+		if re.MatchString(addressAuth.Name) {
+			return addressAuth, nil
+		}
+	}
+	return AddressAuth{}, ErrNotFound
+}
+
+func (s *MemoryStore) ListAddressAuth() ([]AddressAuth, error) {
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+
+	addressAuths := make([]AddressAuth, len(s.addressAuths))
+	copy(addressAuths, s.addressAuths)
+	return addressAuths, nil
+}
+
+func (s *MemoryStore) ActivateAddress(name string) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx := range s.addressAuths {
+		if s.addressAuths[idx].Name == name {
+			s.addressAuths[idx].Enabled = true
+			s.addressAuths[idx].ActivationCode = ""
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) DeleteAddressAuth(name string) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx := range s.addressAuths {
+		if s.addressAuths[idx].Name == name {
+			s.addressAuths = append(s.addressAuths[:idx], s.addressAuths[idx+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) UpsertEndpoint(endpoint kite.Endpoint) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx := range s.endpoints {
+		if s.endpoints[idx].Name == endpoint.Name {
+			endpoint.Id = s.endpoints[idx].Id
+			s.endpoints[idx] = endpoint
+			return nil
+		}
+	}
+	if endpoint.Id.IsZero() {
+		endpoint.Id = primitive.NewObjectID()
+	}
+	s.endpoints = append(s.endpoints, endpoint)
+	return nil
+}
+
+func (s *MemoryStore) FindEndpoint(pattern string) ([]kite.Endpoint, error) {
+	var endpoints []kite.Endpoint
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+	for _, endpoint := range s.endpoints {
+		if re.MatchString(endpoint.Name) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+func (s *MemoryStore) QueueMessage(queued QueuedMessage, limit int) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	if queued.Id.IsZero() {
+		queued.Id = primitive.NewObjectID()
+	}
+	s.outbox = append(s.outbox, queued)
+
+	// Dropping oldest messages of receiver above limit
+	count := 0
+	for _, q := range s.outbox {
+		if q.Receiver == queued.Receiver {
+			count++
+		}
+	}
+	outbox := s.outbox[:0]
+	for _, q := range s.outbox {
+		if q.Receiver == queued.Receiver && count > limit {
+			count--
+			continue
+		}
+		outbox = append(outbox, q)
+	}
+	s.outbox = outbox
+	return nil
+}
+
+func (s *MemoryStore) QueuedMessages(address kite.Address) ([]QueuedMessage, error) {
+	var queued []QueuedMessage
+
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+
+	for _, q := range s.outbox {
+		if address.Match(q.Message.Receiver) {
+			queued = append(queued, q)
+		}
+	}
+	sortQueued(queued)
+	return queued, nil
+}
+
+func (s *MemoryStore) DeleteMessage(id primitive.ObjectID) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx, q := range s.outbox {
+		if q.Id == id {
+			s.outbox = append(s.outbox[:idx], s.outbox[idx+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryStore) PurgeMessages(before time.Time) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	outbox := s.outbox[:0]
+	for _, q := range s.outbox {
+		if !q.Time.Before(before) {
+			outbox = append(outbox, q)
+		}
+	}
+	s.outbox = outbox
+	return nil
+}
+
+func (s *MemoryStore) UpsertPresence(presence Presence) error {
+	s.sync.Lock()
+	defer s.sync.Unlock()
+
+	for idx := range s.presences {
+		if s.presences[idx].Address == presence.Address {
+			s.presences[idx] = presence
+			return nil
+		}
+	}
+	s.presences = append(s.presences, presence)
+	return nil
+}
+
+func (s *MemoryStore) ListPresence() ([]Presence, error) {
+	s.sync.RLock()
+	defer s.sync.RUnlock()
+
+	presences := make([]Presence, len(s.presences))
+	copy(presences, s.presences)
+	return presences, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/url"
+	"time"
+)
+
+// MongoStore is the Store implementation backed by a MongoDB (Atlas) cluster
+type MongoStore struct {
+	conf   ServerConf
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+func (s *MongoStore) Connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	uri := fmt.Sprintf("mongodb+srv://%s:%s@%s/%s?retryWrites=true&w=majority",
+		s.conf.DatabaseUsername,
+		url.QueryEscape(s.conf.DatabasePassword),
+		s.conf.DatabaseServer,
+		s.conf.DatabaseName)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+	s.client = client
+	s.db = client.Database(s.conf.DatabaseName)
+	return nil
+}
+
+func (s *MongoStore) Close() error {
+	if s.client == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.client.Disconnect(ctx)
+}
+
+func (s *MongoStore) WriteLog(logMessage kite.LogMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	logMessageCollection := s.db.Collection(string(kite.C_LOG))
+	_, err := logMessageCollection.InsertOne(ctx, logMessage)
+	return err
+}
+
+func (s *MongoStore) ReadLog(filter string) ([]kite.LogMessage, error) {
+	var messages []kite.LogMessage
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.D{
+		{"$or", []interface{}{
+			bson.D{{"address", bson.D{{"$regex", filter}}}},
+			bson.D{{"message", bson.D{{"$regex", filter}}}},
+		}},
+	}
+	logMessageCollection := s.db.Collection(string(kite.C_LOG))
+	cursor, err := logMessageCollection.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *MongoStore) UpsertAddressAuth(addressAuth AddressAuth) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addressAuthCollection := s.db.Collection(string(kite.C_ADDRESSAUTH))
+
+	update := bson.M{"$set": addressAuth}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := addressAuthCollection.UpdateOne(ctx, bson.D{{"name", addressAuth.Name}}, update, opts)
+	return err
+}
+
+func (s *MongoStore) FindAddressAuth(pattern string) (AddressAuth, error) {
+	var addressAuth AddressAuth
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addressAuthCollection := s.db.Collection(string(kite.C_ADDRESSAUTH))
+	query := bson.D{{"name", bson.D{{"$regex", pattern}}}}
+
+	if err := addressAuthCollection.FindOne(ctx, query).Decode(&addressAuth); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			err = ErrNotFound
+		}
+		return AddressAuth{}, err
+	}
+	return addressAuth, nil
+}
+
+func (s *MongoStore) ListAddressAuth() ([]AddressAuth, error) {
+	var addressAuths []AddressAuth
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addressAuthCollection := s.db.Collection(string(kite.C_ADDRESSAUTH))
+	cursor, err := addressAuthCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &addressAuths); err != nil {
+		return nil, err
+	}
+	return addressAuths, nil
+}
+
+func (s *MongoStore) ActivateAddress(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addressAuthCollection := s.db.Collection(string(kite.C_ADDRESSAUTH))
+	query := bson.M{"name": name}
+	update := bson.M{"$set": bson.M{
+		"enabled":         true,
+		"activation_code": "",
+	}}
+
+	if result := addressAuthCollection.FindOneAndUpdate(ctx, query, update); result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrNotFound
+		}
+		return result.Err()
+	}
+	return nil
+}
+
+func (s *MongoStore) DeleteAddressAuth(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addressAuthCollection := s.db.Collection(string(kite.C_ADDRESSAUTH))
+	result, err := addressAuthCollection.DeleteOne(ctx, bson.D{{"name", name}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) UpsertEndpoint(endpoint kite.Endpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpointCollection := s.db.Collection(string(kite.C_ENDPOINT))
+
+	update := bson.M{"$set": endpoint}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := endpointCollection.UpdateOne(ctx, bson.D{{"name", endpoint.Name}}, update, opts)
+	return err
+}
+
+func (s *MongoStore) FindEndpoint(pattern string) ([]kite.Endpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	endpointCollection := s.db.Collection(string(kite.C_ENDPOINT))
+	query := bson.D{{"name", bson.D{{"$regex", pattern}}}}
+
+	cursor, err := endpointCollection.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var endpoints []kite.Endpoint
+	for cursor.Next(ctx) {
+		endpoint := kite.Endpoint{}
+		if err := cursor.Decode(&endpoint); err == nil {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints, nil
+}
+
+func (s *MongoStore) QueueMessage(queued QueuedMessage, limit int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outboxCollection := s.db.Collection(string(C_OUTBOX))
+	if _, err := outboxCollection.InsertOne(ctx, queued); err != nil {
+		return err
+	}
+
+	// Dropping oldest messages of receiver above limit
+	query := bson.D{{"receiver", queued.Receiver}}
+	count, err := outboxCollection.CountDocuments(ctx, query)
+	if err != nil || count <= int64(limit) {
+		return err
+	}
+	opts := options.Find().SetSort(bson.D{{"time", 1}}).SetLimit(count - int64(limit)).SetProjection(bson.D{{"_id", 1}})
+	cursor, err := outboxCollection.Find(ctx, query, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var dropped []QueuedMessage
+	if err := cursor.All(ctx, &dropped); err != nil {
+		return err
+	}
+	ids := make([]primitive.ObjectID, 0, len(dropped))
+	for _, q := range dropped {
+		ids = append(ids, q.Id)
+	}
+	_, err = outboxCollection.DeleteMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}})
+	return err
+}
+
+func (s *MongoStore) QueuedMessages(address kite.Address) ([]QueuedMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Receivers are address patterns, each part of receiver is the address one or a wildcard
+	query := bson.D{
+		{"message.receiver.domain", bson.D{{"$in", bson.A{address.Domain, "*"}}}},
+		{"message.receiver.type", bson.D{{"$in", bson.A{address.Type, "*"}}}},
+		{"message.receiver.host", bson.D{{"$in", bson.A{address.Host, "*"}}}},
+		{"message.receiver.address", bson.D{{"$in", bson.A{address.Address, "*"}}}},
+		{"message.receiver.id", bson.D{{"$in", bson.A{address.Id, "*"}}}},
+	}
+	outboxCollection := s.db.Collection(string(C_OUTBOX))
+	cursor, err := outboxCollection.Find(ctx, query, options.Find().SetSort(bson.D{{"time", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var queued []QueuedMessage
+	for cursor.Next(ctx) {
+		q, err := decodeQueuedMessage(cursor.Current)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, q)
+	}
+	return queued, cursor.Err()
+}
+
+// decodeQueuedMessage function decode queued message document, payload documents and arrays are converted to
+// their JSON types, so message is sent as it was received
+func decodeQueuedMessage(document bson.Raw) (QueuedMessage, error) {
+	q := QueuedMessage{}
+	if err := bson.Unmarshal(document, &q); err != nil {
+		return q, err
+	}
+	q.Message.Data = jsonCompatible(q.Message.Data)
+	return q, nil
+}
+
+// jsonCompatible function convert value decoded from bson (ordered documents, arrays and integers) to JSON types
+func jsonCompatible(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = jsonCompatible(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]interface{}, len(v))
+		for key, e := range v {
+			m[key] = jsonCompatible(e)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for idx, e := range v {
+			a[idx] = jsonCompatible(e)
+		}
+		return a
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	default:
+		return value
+	}
+}
+
+func (s *MongoStore) DeleteMessage(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outboxCollection := s.db.Collection(string(C_OUTBOX))
+	result, err := outboxCollection.DeleteOne(ctx, bson.D{{"_id", id}})
+	if err == nil && result.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) PurgeMessages(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outboxCollection := s.db.Collection(string(C_OUTBOX))
+	_, err := outboxCollection.DeleteMany(ctx, bson.D{{"time", bson.D{{"$lt", before}}}})
+	return err
+}
+
+func (s *MongoStore) UpsertPresence(presence Presence) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	presenceCollection := s.db.Collection(string(C_PRESENCE))
+
+	update := bson.M{"$set": presence}
+	opts := options.Update().SetUpsert(true)
+
+	_, err := presenceCollection.UpdateOne(ctx, bson.D{{"address", presence.Address}}, update, opts)
+	return err
+}
+
+func (s *MongoStore) ListPresence() ([]Presence, error) {
+	var presences []Presence
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	presenceCollection := s.db.Collection(string(C_PRESENCE))
+	cursor, err := presenceCollection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	if err := cursor.All(ctx, &presences); err != nil {
+		return nil, err
+	}
+	return presences, nil
+}
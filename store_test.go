@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestStore check embedded storage backends behave the same way
+func TestStore(t *testing.T) {
+	for _, driver := range []string{D_MEMORY, D_BOLT} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := newStore(ServerConf{DatabaseDriver: driver, DatabaseFile: filepath.Join(t.TempDir(), "kite.db")})
+			if err != nil {
+				t.Fatalf("creating store --> %v", err)
+			}
+			if err := store.Connect(); err != nil {
+				t.Fatalf("connecting store --> %v", err)
+			}
+			defer store.Close()
+
+			// Logs
+			_ = store.WriteLog(kite.LogMessage{Address: "test.cli.admin.*.*", Message: "first"})
+			_ = store.WriteLog(kite.LogMessage{Address: "test.iot.sensor.*.*", Message: "second"})
+			if logs, err := store.ReadLog("sensor"); err != nil || len(logs) != 1 || logs[0].Message != "second" {
+				t.Errorf("ReadLog(sensor) = %v, %v", logs, err)
+			}
+
+			// Address authorizations and activation
+			if _, err := store.FindAddressAuth(addressAuthPattern("test.cli.admin.console.1")); err != ErrNotFound {
+				t.Errorf("FindAddressAuth on empty store = %v, want ErrNotFound", err)
+			}
+			_ = store.UpsertAddressAuth(AddressAuth{
+				AddressAuth: kite.AddressAuth{Name: "test.cli.admin.*.*", ApiKey: "admin-api-key-0001", ActivationCode: "ABC123"},
+				Acl:         []AclRule{{Receiver: "test.iot.*.*.*", Actions: []kite.Action{kite.A_CMD}}},
+			})
+			if err := store.ActivateAddress("test.cli.unknown.*.*"); err != ErrNotFound {
+				t.Errorf("ActivateAddress(unknown) = %v, want ErrNotFound", err)
+			}
+			if err := store.ActivateAddress("test.cli.admin.*.*"); err != nil {
+				t.Errorf("ActivateAddress(admin) = %v", err)
+			}
+			if auths, err := store.ListAddressAuth(); err != nil || len(auths) != 1 {
+				t.Errorf("ListAddressAuth = %v, %v", auths, err)
+			}
+			if auth, err := store.FindAddressAuth(addressAuthPattern("test.cli.admin.console.1")); err != nil || !auth.Enabled || auth.ActivationCode != "" || len(auth.Acl) != 1 {
+				t.Errorf("FindAddressAuth after activation = %v, %v", auth, err)
+			}
+
+			// Endpoints
+			_ = store.UpsertEndpoint(kite.Endpoint{Name: "test.endpoint.sensor.relay.1"})
+			_ = store.UpsertEndpoint(kite.Endpoint{Name: "test.endpoint.sensor.relay.1", Description: "updated"})
+			_ = store.UpsertEndpoint(kite.Endpoint{Name: "test.endpoint.other.relay.1"})
+			endpoints, err := store.FindEndpoint(endpointPattern(address("test.iot.sensor.board.1")))
+			if err != nil || len(endpoints) != 1 || endpoints[0].Description != "updated" {
+				t.Errorf("FindEndpoint = %v, %v", endpoints, err)
+			}
+
+			// Outbox
+			now := time.Now()
+			receiver := address("test.iot.sensor.board.1")
+			for _, data := range []string{"dropped", "kept", "last"} {
+				_ = store.QueueMessage(QueuedMessage{Time: now, Receiver: receiver.String(), Message: Envelope{Message: kite.Message{Receiver: receiver, Data: data}}}, 2)
+			}
+			_ = store.QueueMessage(QueuedMessage{Time: now.Add(-time.Hour), Receiver: "test.iot.other.*.*", Message: Envelope{Message: kite.Message{Receiver: address("test.iot.other.*.*"), Data: "expired"}}}, 2)
+			_ = store.PurgeMessages(now.Add(-time.Minute))
+			if queued, _ := store.QueuedMessages(address("test.iot.other.board.1")); len(queued) != 0 {
+				t.Errorf("QueuedMessages of expired = %v", queued)
+			}
+			queued, err := store.QueuedMessages(receiver)
+			if err != nil || len(queued) != 2 || queued[0].Message.Data != "kept" || queued[1].Message.Data != "last" {
+				t.Fatalf("QueuedMessages = %v, %v", queued, err)
+			}
+			if err := store.DeleteMessage(queued[0].Id); err != nil {
+				t.Errorf("DeleteMessage --> %v", err)
+			}
+			if err := store.DeleteMessage(queued[0].Id); err != ErrNotFound {
+				t.Errorf("DeleteMessage twice --> %v", err)
+			}
+			if queued, _ := store.QueuedMessages(receiver); len(queued) != 1 || queued[0].Message.Data != "last" {
+				t.Errorf("QueuedMessages after delete = %v", queued)
+			}
+
+			// Structured payload is queued as received
+			payload := map[string]interface{}{"temp": 21.5, "tags": []interface{}{"kitchen", 2.0}, "unit": map[string]interface{}{"name": "C"}}
+			_ = store.QueueMessage(QueuedMessage{Time: now, Receiver: "test.iot.other.board.1", Message: Envelope{Message: kite.Message{Receiver: address("test.iot.other.board.1"), Data: payload}}}, 2)
+			if queued, err := store.QueuedMessages(address("test.iot.other.board.1")); err != nil || len(queued) != 1 || !reflect.DeepEqual(queued[0].Message.Data, payload) {
+				t.Errorf("QueuedMessages of structured payload = %v, %v", queued, err)
+			}
+
+			// Presence
+			_ = store.UpsertPresence(Presence{Address: "test.iot.sensor.board.1", Online: true, LastConnected: now})
+			_ = store.UpsertPresence(Presence{Address: "test.iot.sensor.board.1", Online: false, LastConnected: now, LastSeen: now})
+			if presences, err := store.ListPresence(); err != nil || len(presences) != 1 || presences[0].Online || !presences[0].LastSeen.Equal(now) {
+				t.Errorf("ListPresence = %v, %v", presences, err)
+			}
+		})
+	}
+}
+
+// TestMongoQueuedMessage check structured payload survives bson encoding of MongoDB outbox
+func TestMongoQueuedMessage(t *testing.T) {
+	payload := map[string]interface{}{"temp": 21.5, "count": int32(3), "tags": []interface{}{"kitchen", 2.0}, "unit": map[string]interface{}{"name": "C"}}
+	document, err := bson.Marshal(QueuedMessage{Time: time.Now(), Receiver: "test.iot.sensor.board.1", Message: Envelope{Message: kite.Message{Receiver: address("test.iot.sensor.board.1"), Data: payload}}})
+	if err != nil {
+		t.Fatalf("encoding queued message --> %v", err)
+	}
+	q, err := decodeQueuedMessage(document)
+	if err != nil {
+		t.Fatalf("decoding queued message --> %v", err)
+	}
+	content, _ := json.Marshal(q.Message.Data)
+	if string(content) != `{"count":3,"tags":["kitchen",2],"temp":21.5,"unit":{"name":"C"}}` {
+		t.Errorf("payload sent as %s", content)
+	}
+}
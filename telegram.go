@@ -9,14 +9,13 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 )
 
 type (
 	TmeConf struct {
-		BotId       string `json:"bot_id"`
+		BotId       string `json:"bot_id" conf:"secret"`
 		ChatId      int64  `json:"chat_id"`
 		WebhookPath string `json:"webhook_path"`
 		WebhookUrl  string `json:"webhook_url"`
@@ -78,32 +77,50 @@ type (
 // configureTelegram function load telegram configuration files and configure handler for telegram Bot API
 func (ks *KiteServer) configureTelegram() {
 
-	// Testing if config file exist if not loggin an error
-	if _, err := os.Stat(ks.conf.TelegramConf); err != nil {
-		log.Printf("Error loading telegram configuration --> %v", err)
-		return
-	}
+	conf := ks.config()
+	tme := TmeConf{}
 
-	// Reading and parsing configuration file
-	if buffer, err := ioutil.ReadFile(ks.conf.TelegramConf); err != nil {
-		log.Printf("Error readin telegram configuration --> %v", err)
-		return
-	} else {
-		if err := json.Unmarshal(buffer, &ks.tme); err != nil {
-			log.Printf(fmt.Sprintf("Error parsing telegram configuration --> %v", err))
+	// Reading and parsing configuration file, configuration can also be given directly in server configuration
+	if conf.TelegramConf != "" {
+		if buffer, err := ioutil.ReadFile(conf.TelegramConf); err != nil {
+			log.Printf("Error readin telegram configuration --> %v", err)
 			return
+		} else {
+			if err := json.Unmarshal(buffer, &tme); err != nil {
+				log.Printf(fmt.Sprintf("Error parsing telegram configuration --> %v", err))
+				return
+			}
 		}
 	}
 
-	if ks.tme.WebhookPath == "" || ks.tme.WebhookUrl == "" {
+	// Values of server configuration (environment or command line) override configuration file
+	if conf.Telegram.BotId != "" {
+		tme.BotId = conf.Telegram.BotId
+	}
+	if conf.Telegram.ChatId != 0 {
+		tme.ChatId = conf.Telegram.ChatId
+	}
+	if conf.Telegram.WebhookPath != "" {
+		tme.WebhookPath = conf.Telegram.WebhookPath
+	}
+	if conf.Telegram.WebhookUrl != "" {
+		tme.WebhookUrl = conf.Telegram.WebhookUrl
+	}
+	if tme.BotId == "" {
+		log.Printf("Telegram bot not configured")
+		return
+	}
+	ks.setTelegram(tme)
+
+	if tme.WebhookPath == "" || tme.WebhookUrl == "" {
 		return
 	}
 	// Configure Telegram webhook URL to receive update
-	ks.mux.HandleFunc(fmt.Sprintf("/tme/%s", ks.tme.WebhookPath), ks.telegramReceiver)
+	ks.mux.HandleFunc(fmt.Sprintf("/tme/%s", tme.WebhookPath), ks.telegramReceiver)
 
 	// Set webhook path
-	tmeUrl := url.URL{Host: "api.telegram.org", Scheme: "https", Path: "/" + ks.tme.BotId + "/setWebhook"}
-	tmeBody, _ := json.Marshal(TmeWebhook{Url: fmt.Sprintf("%s%s", ks.tme.WebhookUrl, ks.tme.WebhookPath), DropPendingUpdates: true})
+	tmeUrl := url.URL{Host: "api.telegram.org", Scheme: "https", Path: "/" + tme.BotId + "/setWebhook"}
+	tmeBody, _ := json.Marshal(TmeWebhook{Url: fmt.Sprintf("%s%s", tme.WebhookUrl, tme.WebhookPath), DropPendingUpdates: true})
 	if request, err := http.NewRequest("POST", tmeUrl.String(), bytes.NewBuffer(tmeBody)); err == nil {
 		request.Header.Set("Content-Type", "application/json")
 		client := &http.Client{}
@@ -117,7 +134,20 @@ func (ks *KiteServer) configureTelegram() {
 	} else {
 		log.Printf("Error creation http Request --> %v\n", err)
 	}
-	log.Printf("Telegram Webhook listening on /tme/%s...", ks.tme.WebhookPath)
+	log.Printf("Telegram Webhook listening on /tme/%s...", tme.WebhookPath)
+}
+
+// telegram function return current Telegram configuration, configuration is replaced when reloaded
+func (ks *KiteServer) telegram() TmeConf {
+	ks.settings.RLock()
+	defer ks.settings.RUnlock()
+	return ks.tme
+}
+
+func (ks *KiteServer) setTelegram(tme TmeConf) {
+	ks.settings.Lock()
+	defer ks.settings.Unlock()
+	ks.tme = tme
 }
 
 // telegramReceiver function handle update message from telegram bot
@@ -128,6 +158,11 @@ func (ks *KiteServer) telegramReceiver(w http.ResponseWriter, r *http.Request) {
 		update := TmeUpdate{}
 		if err := json.Unmarshal(body, &update); err == nil {
 			message := update.Message
+			// Webhook is not authenticated, only messages from configured chat are handled
+			if chatId := ks.telegram().ChatId; chatId == 0 || message.Chat.Id != chatId {
+				log.Printf("Telegram update %d from unknown chat %d ignored", update.UpdateId, message.Chat.Id)
+				return
+			}
 			// Parse message to send notification
 			if parsed := inputRe.FindStringSubmatch(message.Text); parsed != nil {
 
@@ -144,19 +179,23 @@ func (ks *KiteServer) telegramReceiver(w http.ResponseWriter, r *http.Request) {
 				switch action {
 				case kite.A_NOTIFY:
 					data := parsed[3]
-					ks.address.Notify(kite.Event{Data: data, Action: kite.A_NOTIFY}, new(AddressObs), to)
+					ks.notify(kite.Event{Data: data, Action: kite.A_NOTIFY}, new(AddressObs), to)
 					break
 				case kite.A_LOG:
 					log.Printf("Telegram %d message from %s %s:\n%s", update.UpdateId, message.From.FirstName, message.From.LastName, message.Text)
 					break
 				case kite.A_ACTIVATE:
-					if err := ks.activateAddress(parsed[3]); err == nil {
+					if err := ks.activateAddress(parsed[3], fmt.Sprintf("telegram:%d", message.Chat.Id)); err == nil {
 						log.Printf("New address activated")
+					} else {
+						log.Printf("Activation from Telegram chat %d failed --> %v", message.Chat.Id, err)
 					}
 					break
 				case kite.A_CMD:
-					data := parsed[3]
-					ks.address.Notify(kite.Event{Data: data, Action: kite.A_CMD}, new(AddressObs), to)
+					// Device reply is sent back to Telegram chat
+					command := Envelope{Message: kite.Message{Action: kite.A_CMD, Sender: telegramAddress, Receiver: to, Data: parsed[3]}, Id: newMessageId()}
+					ks.trackRequest(&command, nil)
+					ks.route(command, nil)
 					break
 				default:
 					log.Printf("Unhandled or unknown action %s for Telegram message from %s %s:\n%s", action, message.From.FirstName, message.From.LastName, message.Text)
@@ -172,13 +211,14 @@ func (ks *KiteServer) telegramReceiver(w http.ResponseWriter, r *http.Request) {
 
 // sendToTelegram function sending a message to telegram bot
 func (ks *KiteServer) sendToTelegram(msg string) {
-	if ks.tme == (TmeConf{}) {
+	tme := ks.telegram()
+	if tme == (TmeConf{}) {
 		log.Printf("Telegram bot not configured, message ignored")
 		return
 	}
 
-	tmeUrl := url.URL{Host: "api.telegram.org", Scheme: "https", Path: "/" + ks.tme.BotId + "/sendMessage"}
-	tmeBody, _ := json.Marshal(TmeSendMessageParam{ChatId: ks.tme.ChatId, DisableNotification: false, Text: msg})
+	tmeUrl := url.URL{Host: "api.telegram.org", Scheme: "https", Path: "/" + tme.BotId + "/sendMessage"}
+	tmeBody, _ := json.Marshal(TmeSendMessageParam{ChatId: tme.ChatId, DisableNotification: false, Text: msg})
 
 	if request, err := http.NewRequest("POST", tmeUrl.String(), bytes.NewBuffer(tmeBody)); err == nil {
 		request.Header.Set("Content-Type", "application/json")
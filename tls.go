@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	kite "github.com/get-code-ch/kite-common"
+	"io/ioutil"
+	"net/url"
+)
+
+// tlsConfig function return server TLS configuration, client certificate is required when client_auth is set
+func (ks *KiteServer) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if !ks.config().Cert.ClientAuth {
+		return config, nil
+	}
+
+	// Loading CA bundle used to verify client certificates
+	buffer, err := ioutil.ReadFile(ks.config().Cert.ClientCa)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle --> %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buffer) {
+		return nil, errors.New("no certificate found in client CA bundle")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// Loading revocation list, it must be signed by one of CA
+	if ks.config().Cert.Crl != "" {
+		revoked, err := loadCrl(ks.config().Cert.Crl, buffer)
+		if err != nil {
+			return nil, err
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if _, ok := revoked[cert.SerialNumber.String()]; ok {
+						return fmt.Errorf("certificate %s is revoked", cert.Subject)
+					}
+				}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// loadCrl function parse revocation list (PEM or DER) and return revoked serial numbers
+func loadCrl(crlFile string, caBundle []byte) (map[string]struct{}, error) {
+	buffer, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading revocation list --> %v", err)
+	}
+	crl, err := x509.ParseCRL(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("parsing revocation list --> %v", err)
+	}
+
+	signed := false
+	for block, rest := pem.Decode(caBundle); block != nil; block, rest = pem.Decode(rest) {
+		if ca, err := x509.ParseCertificate(block.Bytes); err == nil && ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errors.New("revocation list is not signed by client CA")
+	}
+
+	revoked := make(map[string]struct{})
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[cert.SerialNumber.String()] = struct{}{}
+	}
+	return revoked, nil
+}
+
+// certificateAddress function return address pattern identified by client certificate,
+// from an URI SAN (kite:domain.type.host.address.id) or else from subject common name
+func certificateAddress(cert *x509.Certificate) (kite.Address, error) {
+	identity := ""
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "kite" {
+			identity = uri.Opaque
+			if identity == "" {
+				identity = uri.Host
+			}
+			if unescaped, err := url.PathUnescape(identity); err == nil {
+				identity = unescaped
+			}
+			break
+		}
+	}
+	if identity == "" {
+		identity = cert.Subject.CommonName
+	}
+	if identity == "" {
+		return kite.Address{}, errors.New("no address in client certificate")
+	}
+
+	address := kite.Address{}
+	address.StringToAddress(identity)
+	return address, nil
+}
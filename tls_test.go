@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+type testCa struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCa(t *testing.T) testCa {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kite test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA --> %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return testCa{cert: cert, key: key}
+}
+
+// issue function create a client certificate, identity is set as URI SAN when prefixed by kite: else as common name
+func (ca testCa) issue(t *testing.T, serial int64, identity string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if strings.HasPrefix(identity, "kite:") {
+		uri, _ := url.Parse(identity)
+		template.URIs = []*url.URL{uri}
+	} else {
+		template.Subject = pkix.Name{CommonName: identity}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("creating client certificate --> %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCa(t)
+	dir := t.TempDir()
+
+	// CA bundle and revocation list of serial 3
+	caFile := filepath.Join(dir, "ca.crt")
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now().Add(-time.Hour),
+		NextUpdate:          time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{{SerialNumber: big.NewInt(3), RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("creating revocation list --> %v", err)
+	}
+	crlFile := filepath.Join(dir, "ca.crl")
+	_ = ioutil.WriteFile(crlFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600)
+
+	ks, _ := newTestServer(t, func(conf *ServerConf) {
+		conf.Ssl = true
+		conf.Cert = ConfCertificate{ClientAuth: true, ClientCa: caFile, Crl: crlFile}
+	})
+	config, err := ks.tlsConfig()
+	if err != nil {
+		t.Fatalf("configuring TLS --> %v", err)
+	}
+	srv := httptest.NewUnstartedServer(ks.mux)
+	srv.TLS = config
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	dialTls := func(cert *tls.Certificate, sender string) (*testClient, Envelope, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(srv.Certificate())
+		dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+		if cert != nil {
+			dialer.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		conn, _, err := dialer.Dial("wss"+strings.TrimPrefix(srv.URL, "https")+"/ws", http.Header{"Origin": {srv.URL}})
+		if err != nil {
+			return nil, Envelope{}, err
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		c := &testClient{conn: conn, address: address(sender)}
+		c.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testIotKey, Version: maxProtocolVersion, Capabilities: testCapabilities})
+		msg, err := c.receive()
+		return c, msg, err
+	}
+
+	iotCert := ca.issue(t, 2, "kite:test.iot.sensor.*.*")
+	if _, msg, err := dialTls(&iotCert, testIotAddress); err != nil || msg.Action != kite.A_ACCEPTED {
+		t.Errorf("certificate matching address got %s, %v", msg.Action, err)
+	}
+
+	browserCert := ca.issue(t, 4, "test.browser.web.*.*")
+	if _, msg, err := dialTls(&browserCert, testIotAddress); err != nil || msg.Action != A_ERROR {
+		t.Errorf("certificate of other address got %s, %v", msg.Action, err)
+	}
+
+	revokedCert := ca.issue(t, 3, "kite:test.iot.sensor.*.*")
+	if _, _, err := dialTls(&revokedCert, testIotAddress); err == nil {
+		t.Error("revoked certificate accepted")
+	}
+
+	if _, _, err := dialTls(nil, testIotAddress); err == nil {
+		t.Error("connection without certificate accepted")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+// ConfWebsocket define liveness and tuning of websocket connections, durations are in seconds and sizes in bytes
+type ConfWebsocket struct {
+	PingInterval     int  `json:"ping_interval"`
+	PongTimeout      int  `json:"pong_timeout"`
+	WriteTimeout     int  `json:"write_timeout"`
+	ReadBufferSize   int  `json:"read_buffer_size"`
+	WriteBufferSize  int  `json:"write_buffer_size"`
+	Compression      bool `json:"compression"`
+	CompressionLevel int  `json:"compression_level"`
+	MaxMessageSize   int  `json:"max_message_size"`
+}
+
+const (
+	defaultPingInterval     = 60
+	defaultPongTimeout      = 30
+	defaultWriteTimeout     = 10
+	defaultBufferSize       = 2048
+	defaultCompressionLevel = 1
+	defaultMaxMessageSize   = 1 << 20
+
+	// Compression levels of permessage-deflate (compress/flate), 1 is fastest and 9 best compression
+	maxCompressionLevel = 9
+)
+
+// pingInterval function return delay between two pings sent to address
+func (c ConfWebsocket) pingInterval() time.Duration {
+	return seconds(c.PingInterval, defaultPingInterval)
+}
+
+// pongTimeout function return delay to receive pong after a ping before connection is considered dead
+func (c ConfWebsocket) pongTimeout() time.Duration {
+	return seconds(c.PongTimeout, defaultPongTimeout)
+}
+
+// writeTimeout function return max delay to write a message or a control frame to address
+func (c ConfWebsocket) writeTimeout() time.Duration {
+	return seconds(c.WriteTimeout, defaultWriteTimeout)
+}
+
+// readDeadline function return time until which something (message or pong) must be received from address,
+// deadline is extended each time something is received
+func (c ConfWebsocket) readDeadline() time.Time {
+	return time.Now().Add(c.pingInterval() + c.pongTimeout())
+}
+
+func seconds(value int, defaultValue int) time.Duration {
+	if value <= 0 {
+		value = defaultValue
+	}
+	return time.Duration(value) * time.Second
+}
+
+// compressionLevel function return compression level of messages sent when compression is negotiated with client
+func (c ConfWebsocket) compressionLevel() int {
+	if c.CompressionLevel <= 0 {
+		return defaultCompressionLevel
+	}
+	return c.CompressionLevel
+}
+
+// maxMessageSize function return max size of a message received, connection is closed when a message is larger
+func (c ConfWebsocket) maxMessageSize() int64 {
+	if c.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return int64(c.MaxMessageSize)
+}
+
+// newUpgrader function return websocket upgrader serving kite subprotocols, permessage-deflate compression is
+// negotiated with clients supporting it when enabled
+func newUpgrader(c ConfWebsocket) websocket.Upgrader {
+	readBufferSize, writeBufferSize := c.ReadBufferSize, c.WriteBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = defaultBufferSize
+	}
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultBufferSize
+	}
+	return websocket.Upgrader{
+		ReadBufferSize:    readBufferSize,
+		WriteBufferSize:   writeBufferSize,
+		EnableCompression: c.Compression,
+		Subprotocols:      subprotocols(),
+		CheckOrigin:       func(r *http.Request) bool { return false },
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	kite "github.com/get-code-ch/kite-common"
+	"github.com/gorilla/websocket"
+)
+
+func TestLiveness(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Websocket = ConfWebsocket{PingInterval: 1, PongTimeout: 1, WriteTimeout: 1}
+	})
+
+	// Pings are answered only while client reads connection
+	alive := connect(t, ks, srv, testAdminAddress, testAdminKey)
+	go func() {
+		for {
+			if _, _, err := alive.conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	dead := connect(t, ks, srv, testBrowserAddress, testBrowserKey)
+	obs := observer(ks, dead.address)
+
+	waitFor(t, "dead connection deregistered", func() bool { return !registered(ks, dead.address) })
+	select {
+	case <-obs.ctx.Done():
+		break
+	case <-time.After(time.Second):
+		t.Errorf("connection context of %s not canceled", dead.address)
+	}
+
+	// Alive connection survived several ping intervals
+	if !registered(ks, alive.address) {
+		t.Errorf("%s deregistered while answering pings", alive.address)
+	}
+}
+
+func observer(ks *KiteServer, address kite.Address) *AddressObs {
+	ks.observers.RLock()
+	defer ks.observers.RUnlock()
+	for o := range ks.address.Observers {
+		if obs := o.(*AddressObs); obs.address == address {
+			return obs
+		}
+	}
+	return nil
+}
+
+func TestCompressionAndMessageSize(t *testing.T) {
+	ks, srv := newTestServer(t, func(conf *ServerConf) {
+		conf.Websocket = ConfWebsocket{Compression: true, CompressionLevel: 9, MaxMessageSize: 256}
+	})
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(url, http.Header{"Origin": {srv.URL}})
+	if err != nil {
+		t.Fatalf("dialing %s --> %v", url, err)
+	}
+	defer conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Errorf("compression not negotiated, extensions %q", resp.Header.Get("Sec-Websocket-Extensions"))
+	}
+
+	admin := &testClient{conn: conn, address: address(testAdminAddress)}
+	admin.send(t, kite.A_REGISTER, kite.Address{}, Registration{ApiKey: testAdminKey, Version: maxProtocolVersion, Capabilities: []string{F_PRESENCE}})
+	admin.expect(t, kite.A_ACCEPTED)
+	admin.send(t, A_PRESENCE, ks.config().Address, testAdminAddress)
+	admin.expect(t, A_PRESENCE)
+
+	// Oversized message closes connection with reason, even if it is well compressed
+	admin.send(t, kite.A_LOG, ks.config().Address, strings.Repeat("x", 1024))
+	_, err = admin.receive()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseMessageTooBig || !strings.Contains(ce.Text, "256 bytes") {
+		t.Errorf("oversized message got %v, want message too big close", err)
+	}
+	waitFor(t, "oversized sender deregistered", func() bool { return !registered(ks, admin.address) })
+}